@@ -2,11 +2,208 @@ package golfu
 
 import (
 	"context"
+	"time"
 
 	"github.com/JGpGH/golfu/internal"
 	"github.com/JGpGH/golfu/storage"
 )
 
-func NewCachedStorage[T storage.Indexable](ctx context.Context, cold storage.ColdStorage[T], trash storage.Trash[T], maxUnits int) storage.CachedStorage[T] {
-	return internal.NewCachedStorage(ctx, cold, trash, maxUnits)
+// Option tweaks the behavior of a cached storage
+type Option func(*internal.Config)
+
+// max amount of cached values before evicting; 0, the default, never evicts
+func WithMaxUnits(maxUnits int) Option {
+	return func(c *internal.Config) {
+		c.MaxUnits = maxUnits
+	}
+}
+
+// max weight of the cached values before evicting, weighed by WithWeigher or storage.Sizer; 0, the default, never evicts on weight
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *internal.Config) {
+		c.MaxBytes = maxBytes
+	}
+}
+
+// weighs the values in bytes for WithMaxBytes and Stats, in place of storage.Sizer
+func WithWeigher[T storage.Indexable](weigh func(T) int) Option {
+	return func(c *internal.Config) {
+		c.Weigher = weigh
+	}
+}
+
+// share of the max units evicted on top of the overflow, within [0, 1); defaults to 0.2
+func WithEvictionHeadroom(fraction float64) Option {
+	return func(c *internal.Config) {
+		c.EvictionHeadroom = fraction
+	}
+}
+
+// picks what gets evicted, e.g. policy.NewLRU, policy.NewARC or policy.NewWTinyLFU called with the max units,
+// or a capacity estimated from the max bytes without them;
+// defaults to evicting the least read values since the last eviction (LFU)
+func WithEvictionPolicy(policy func(capacity int) storage.EvictionPolicy) Option {
+	return func(c *internal.Config) {
+		c.EvictionPolicy = policy
+	}
+}
+
+// hashes the values to n independent lists so concurrent calls don't contend on a single lock;
+// each evicts on its own, within its share of the max units; defaults to 1
+func WithShards(n int) Option {
+	return func(c *internal.Config) {
+		c.Shards = n
+	}
+}
+
+// max indexes Prefetch loads per ColdStorage.Get; defaults to 100
+func WithPrefetchChunkSize(size int) Option {
+	return func(c *internal.Config) {
+		c.PrefetchChunkSize = size
+	}
+}
+
+// receives the evicted and expired values; they are dropped by default
+func WithTrash[T storage.Indexable](trash storage.Trash[T]) Option {
+	return func(c *internal.Config) {
+		c.Trash = trash
+	}
+}
+
+// buffer of pending writes before Set overflows; defaults to 100
+func WithWriteQueueSize(size int) Option {
+	return func(c *internal.Config) {
+		c.WriteQueueSize = size
+	}
+}
+
+// buffer of pending eviction checks; defaults to 100
+func WithEvictionQueueSize(size int) Option {
+	return func(c *internal.Config) {
+		c.EvictionQueueSize = size
+	}
+}
+
+// makes every Set behave like SetSync, the errors of Set and SetWithTTL go to the error handler
+func WithWriteThrough() Option {
+	return func(c *internal.Config) {
+		c.WriteThrough = true
+	}
+}
+
+// what Set does when the write queue is full; defaults to storage.OverflowBlock
+func WithOverflow(overflow storage.Overflow) Option {
+	return func(c *internal.Config) {
+		c.Overflow = overflow
+	}
+}
+
+// file storage.OverflowSpill appends to, it is truncated when the cache starts
+func WithSpillPath(path string) Option {
+	return func(c *internal.Config) {
+		c.SpillPath = path
+	}
+}
+
+// logs every queued write to path, synced before Set returns, and replays the log when the cache starts,
+// so a crash loses none of the writes not persisted yet; they are cached right away and queued in the background,
+// the writes made meanwhile wait behind them. needs WithCodec
+func WithWAL(path string) Option {
+	return func(c *internal.Config) {
+		c.WALPath = path
+	}
+}
+
+// encodes the values kept on disk, e.g. storage.JSONCodec
+func WithCodec[T storage.Indexable](codec storage.Codec[T]) Option {
+	return func(c *internal.Config) {
+		c.Codec = codec
+	}
+}
+
+// max values per ColdStorage.Set; 0, the default, is unbounded
+func WithBatchSize(size int) Option {
+	return func(c *internal.Config) {
+		c.BatchSize = size
+	}
+}
+
+// how long writes are gathered into a single batch before being persisted, only the last write to each index of a batch
+// reaches the cold storage; 0, the default, persists each Set on its own
+func WithFlushInterval(interval time.Duration) Option {
+	return func(c *internal.Config) {
+		c.FlushInterval = interval
+	}
+}
+
+// delays between retries when the cold storage rejects a batch; defaults to storage.DefaultBackoff()
+func WithBackoff(backoff storage.Backoff) Option {
+	return func(c *internal.Config) {
+		c.Backoff = backoff
+	}
+}
+
+// handler receives every error the background routines run into, e.g. *storage.WriteError;
+// it is called from those routines so it must not block
+func WithErrorHandler(handler func(error)) Option {
+	return func(c *internal.Config) {
+		c.OnError = handler
+	}
+}
+
+// sink for hits, misses, cold storage latencies and evictions
+func WithMetrics(metrics storage.Metrics) Option {
+	return func(c *internal.Config) {
+		c.Metrics = metrics
+	}
+}
+
+// ttl of every value set without one and of those loaded from the cold storage; 0 never expires
+func WithTTL(ttl time.Duration) Option {
+	return func(c *internal.Config) {
+		c.TTL = ttl
+	}
+}
+
+// how often expired values are swept out of the cache; defaults to a second
+func WithExpiryInterval(interval time.Duration) Option {
+	return func(c *internal.Config) {
+		c.ExpiryInterval = interval
+	}
+}
+
+// reloads in the background the values read at least minReads times once less than fraction of their ttl is left,
+// so readers keep being served from the cache; fraction is within (0, 1), disabled by default
+func WithRefreshAhead(fraction float64, minReads uint32) Option {
+	return func(c *internal.Config) {
+		c.RefreshAhead = fraction
+		c.RefreshMinReads = minReads
+	}
+}
+
+// remembers up to maxUnits indexes the cold storage did not have for ttl, so their lookups don't reach it again;
+// a write to an index forgets it right away. Disabled by default
+func WithNegativeCaching(ttl time.Duration, maxUnits int) Option {
+	return func(c *internal.Config) {
+		c.NegativeTTL = ttl
+		c.NegativeMaxUnits = maxUnits
+	}
+}
+
+// returns an error wrapping storage.ErrInvalidConfig when the options don't make sense together
+func New[T storage.Indexable](ctx context.Context, cold storage.ColdStorage[T], opts ...Option) (storage.CachedStorage[T], error) {
+	config := internal.DefaultConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return internal.NewCachedStorageWithConfig(ctx, cold, config)
+}
+
+// panics on invalid options, use New to get the error instead
+func NewCachedStorage[T storage.Indexable](ctx context.Context, cold storage.ColdStorage[T], trash storage.Trash[T], maxUnits int, opts ...Option) storage.CachedStorage[T] {
+	cache, err := New(ctx, cold, append([]Option{WithTrash(trash), WithMaxUnits(maxUnits)}, opts...)...)
+	if err != nil {
+		panic(err)
+	}
+	return cache
 }
@@ -2,125 +2,1019 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/JGpGH/golfu/internal/listop"
 	"github.com/JGpGH/golfu/storage"
 )
 
 func (s *cachedStorage[T]) Start(ctx context.Context, trash storage.Trash[T]) {
+	s.routines.Add(3)
 	// cache storing routine for non-blocking Set
 	go func() {
+		defer s.routines.Done()
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case in := <-s.toCache:
-				l := s.units.Len()
-				units := toUnits(in)
-				s.units.Set(units)
-				s.newLength <- l + len(in)
-				s.cold.Set(asReadOnlyUnits(units))
-				for _, u := range units {
-					u.SetPersisted()
-				}
+				pending := s.gather(ctx, in)
+				s.write(ctx, pending)
+				s.checkpoint(ctx, pending[len(pending)-1].logged)
+				s.progress.complete(uint64(len(pending)))
+				s.unspill(ctx)
+			case <-s.spilled():
+				s.unspill(ctx)
 			}
 		}
 	}()
 
 	// routine to evict units
 	go func() {
+		defer s.routines.Done()
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case u := <-s.newLength:
-				currentLen := max(s.units.Len(), u)
-				if currentLen > s.maxUnits {
-					evicted := s.evict(currentLen - s.maxUnits + s.maxUnits/5) // evict 20% of the cache + everything above max
-					trash.Trash(evicted)
+				s.shrink(trash, u)
+			}
+		}
+	}()
+
+	// routine to sweep expired units
+	go func() {
+		defer s.routines.Done()
+		ticker := time.NewTicker(s.config.ExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if s.expiring.Load() {
+					if expired := s.units.expire(now); len(expired) > 0 {
+						s.bytes.Add(-s.weighValues(expired))
+						s.metrics.Expired(len(expired))
+						trash.Trash(expired)
+					}
 				}
 			}
 		}
 	}()
 }
 
+// evicts everything above the max units and the max bytes, plus the headroom
+func (s *cachedStorage[T]) shrink(trash storage.Trash[T], length int) {
+	maxUnits := s.config.MaxUnits
+	currentLen := max(s.units.len(), length)
+	if maxUnits > 0 && currentLen > maxUnits {
+		s.evicted(trash, s.units.evict(currentLen-maxUnits+int(float64(maxUnits)*s.config.EvictionHeadroom)))
+	}
+	maxBytes := s.config.MaxBytes
+	if maxBytes <= 0 || s.bytes.Load() <= maxBytes {
+		return
+	}
+	target := maxBytes - int64(float64(maxBytes)*s.config.EvictionHeadroom)
+	// policies evict by amount, it is guessed from the average weight until the target is reached
+	for over := s.bytes.Load() - target; over > 0; over = s.bytes.Load() - target {
+		length := int64(s.units.len())
+		if length == 0 {
+			return
+		}
+		average := max(1, s.bytes.Load()/length)
+		evicted := s.units.evict(int(max(1, over/average)))
+		if len(evicted) == 0 {
+			// what is left is not persisted yet
+			return
+		}
+		s.evicted(trash, evicted)
+	}
+}
+
+func (s *cachedStorage[T]) evicted(trash storage.Trash[T], evicted []T) {
+	s.bytes.Add(-s.weighValues(evicted))
+	s.metrics.Evicted(len(evicted))
+	trash.Trash(evicted)
+}
+
 func (s *cachedStorage[T]) Set(values []T) {
+	s.report(values, s.setCtx(context.Background(), values, s.config.TTL))
+}
+
+func (s *cachedStorage[T]) SetCtx(ctx context.Context, values []T) error {
+	return s.setCtx(ctx, values, s.config.TTL)
+}
+
+func (s *cachedStorage[T]) SetWithTTL(values []T, ttl time.Duration) {
+	s.report(values, s.setCtx(context.Background(), values, ttl))
+}
+
+// Set has no error to return, what it could not queue goes to the error handler instead
+func (s *cachedStorage[T]) report(values []T, err error) {
+	if err == nil || errors.Is(err, storage.ErrClosed) {
+		return
+	}
+	var indexes []string
+	for _, v := range values {
+		indexes = append(indexes, v.Index())
+	}
+	s.config.OnError(&storage.WriteError{Indexes: indexes, Err: err})
+}
+
+func (s *cachedStorage[T]) SetSync(values []T) error {
+	return s.setSync(context.Background(), values, s.config.TTL)
+}
+
+func (s *cachedStorage[T]) setCtx(ctx context.Context, values []T, ttl time.Duration) error {
+	if s.config.WriteThrough {
+		return s.setSync(ctx, values, ttl)
+	}
+	if ttl > 0 {
+		s.expiring.Store(true)
+	}
+	var toCache []persistable[T]
+	for _, v := range values {
+		toCache = append(toCache, persistable[T]{value: v, isPersisted: false, ttl: ttl})
+	}
+	return s.enqueueUnits(ctx, toUnits(toCache))
+}
+
+func (s *cachedStorage[T]) setSync(ctx context.Context, values []T, ttl time.Duration) error {
+	return s.writeThrough(values, ttl, func(units []storage.Readonly[T]) error {
+		return s.coldSet(ctx, units)
+	})
+}
+
+// the cold storage write and the cache update share the lock of the write routine's writes,
+// so an older value still queued for an index can't reach the cold storage in between
+func (s *cachedStorage[T]) writeThrough(values []T, ttl time.Duration, write func([]storage.Readonly[T]) error) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.queuing.Done()
 	var toCache []persistable[T]
 	for _, v := range values {
-		toCache = append(toCache, persistable[T]{value: v, isPersisted: false})
+		toCache = append(toCache, persistable[T]{value: v, isPersisted: false, ttl: ttl})
+	}
+	units := toUnits(toCache)
+	if len(units) == 0 {
+		return nil
+	}
+	s.persisting.Lock()
+	defer s.persisting.Unlock()
+	start := time.Now()
+	err := write(asReadOnlyUnits(units))
+	s.metrics.ColdSet(len(units), time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		s.expiring.Store(true)
+	}
+	latest := make(map[string]uint64, len(units))
+	for _, u := range units {
+		u.SetPersisted()
+		latest[u.Index()] = u.version
+	}
+	// a Set made meanwhile is newer and keeps its place
+	s.cache(units, func(old *unit[T]) bool {
+		return old.version < latest[old.Index()]
+	})
+	s.tombstones.remove(indexes(units))
+	s.signalLength()
+	return nil
+}
+
+// checked against the value Get returns, then by the cold storage itself when it is a CompareAndSetter;
+// serialized with the other CompareAndSet of the index, not with Set
+func (s *cachedStorage[T]) CompareAndSet(index string, expectedVersion uint64, value T) error {
+	if value.Index() != index {
+		return fmt.Errorf("golfu: value of index %q set at %q", value.Index(), index)
+	}
+	versioned, ok := any(value).(storage.Versioned)
+	if !ok {
+		return storage.ErrNotVersioned
+	}
+	// a rewound version would be the one every later CompareAndSet is checked against
+	if next := versioned.Version(); next <= expectedVersion {
+		return fmt.Errorf("%w: %q set at version %d, not past %d", storage.ErrVersionConflict, index, next, expectedVersion)
+	}
+	lock := s.keys.lock(index)
+	lock.Lock()
+	defer lock.Unlock()
+	current, err := s.Get([]string{index})
+	if err != nil {
+		return err
+	}
+	var version uint64
+	if old, ok := current[index]; ok {
+		// T may be an interface some of whose values are not versioned
+		versioned, ok := any(old).(storage.Versioned)
+		if !ok {
+			return fmt.Errorf("%w: the value at %q", storage.ErrNotVersioned, index)
+		}
+		version = versioned.Version()
+	}
+	if version != expectedVersion {
+		return fmt.Errorf("%w: %q is at version %d, not %d", storage.ErrVersionConflict, index, version, expectedVersion)
+	}
+	cas, ok := s.cold.(storage.CompareAndSetter[T])
+	if !ok {
+		return s.setCtx(context.Background(), []T{value}, s.config.TTL)
+	}
+	err = s.writeThrough([]T{value}, s.config.TTL, func([]storage.Readonly[T]) error {
+		return cas.CompareAndSet(index, expectedVersion, value)
+	})
+	if errors.Is(err, storage.ErrVersionConflict) {
+		// another writer got to the cold storage, the cached value is stale
+		s.Invalidate([]string{index})
+	}
+	return err
+}
+
+// fn gets the value Get returns and its result is set like Set; an error from fn leaves everything untouched.
+// serialized with the other Update and CompareAndSet of the index, the units it replaces stay as they were queued
+func (s *cachedStorage[T]) Update(index string, fn func(old T, found bool) (T, error)) error {
+	lock := s.keys.lock(index)
+	lock.Lock()
+	defer lock.Unlock()
+	current, err := s.Get([]string{index})
+	if err != nil {
+		return err
+	}
+	old, found := current[index]
+	value, err := fn(old, found)
+	if err != nil {
+		return err
 	}
-	s.toCache <- toCache
+	if value.Index() != index {
+		return fmt.Errorf("golfu: value of index %q set at %q", value.Index(), index)
+	}
+	return s.setCtx(context.Background(), []T{value}, s.config.TTL)
 }
 
+// caches values already in the cold storage without writing them back; they only replace
+// the expired units a Get misses so a concurrent Set keeps the upper hand
 func (s *cachedStorage[T]) SetPersisted(values []T) {
 	var toCache []persistable[T]
 	for _, v := range values {
-		toCache = append(toCache, persistable[T]{value: v, isPersisted: true})
+		toCache = append(toCache, persistable[T]{value: v, isPersisted: true, ttl: s.config.TTL})
+	}
+	now := time.Now()
+	s.cache(toUnits(toCache), func(old *unit[T]) bool {
+		return old.Expired(now) && old.IsPersisted()
+	})
+	s.signalLength()
+}
+
+// cached right away so the caller reads its own writes, persisted by the write routine
+func (s *cachedStorage[T]) enqueueUnits(ctx context.Context, units []*unit[T]) error {
+	if len(units) == 0 {
+		return nil
+	}
+	// counted before the send, the write routine may persist them before the cache is updated
+	s.stats.unpersisted.Add(int64(len(units)))
+	// the eviction check waits for the write routine to persist them, it could only evict others meanwhile
+	err := s.enqueue(ctx, write[T]{units: units}, func() {
+		s.cache(units, nil)
+		s.tombstones.remove(indexes(units))
+		// persisted before they were cached, the check of the write routine saw the length without them
+		for _, u := range units {
+			if u.IsPersisted() {
+				s.signalLength()
+				break
+			}
+		}
+	})
+	if err != nil {
+		s.stats.unpersisted.Add(-int64(len(units)))
+	}
+	return err
+}
+
+func (s *cachedStorage[T]) signalLength() {
+	// a full channel means an eviction check is already pending, it will see the new length
+	select {
+	case s.newLength <- s.units.len():
+	default:
+	}
+}
+
+// removed from the cache right away and from the cold storage in the order it was queued with Set
+func (s *cachedStorage[T]) Delete(indexes []string) {
+	if len(indexes) == 0 {
+		return
+	}
+	version := nextVersion()
+	err := s.enqueue(context.Background(), write[T]{deleted: indexes, version: version}, func() {
+		s.remove(indexes)
+		s.negatives.add(indexes, time.Now())
+	})
+	if err != nil && !errors.Is(err, storage.ErrClosed) {
+		s.config.OnError(&storage.WriteError{Indexes: indexes, Err: err})
+	}
+}
+
+// drops cached units right away without touching the cold storage; pending writes still get persisted
+func (s *cachedStorage[T]) Invalidate(indexes []string) {
+	s.remove(indexes)
+	s.negatives.remove(indexes)
+}
+
+// apply updates the cache once the write is queued; it runs under the same lock as the send so
+// the cache and the cold storage see the writes to an index in the same order
+func (s *cachedStorage[T]) enqueue(ctx context.Context, toCache write[T], apply func()) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.queuing.Done()
+	// a channel rather than a mutex so waiting for the lock also gives up with ctx
+	select {
+	case s.ordering <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.ctx.Done():
+		return storage.ErrClosed
+	}
+	defer func() { <-s.ordering }()
+	// the cold storage still has the deleted indexes until the delete is persisted, which may happen before apply
+	s.tombstones.add(toCache.deleted, toCache.version)
+	offset, err := s.log(&toCache)
+	if err != nil {
+		s.tombstones.land(toCache.deletes())
+		return err
+	}
+	if err := s.queue(ctx, toCache, apply); err != nil {
+		s.tombstones.land(toCache.deletes())
+		if s.wal != nil {
+			err = errors.Join(err, s.wal.rollback(offset))
+		}
+		return err
+	}
+	return nil
+}
+
+// registers a write for Close to wait for, unless the cache is closing
+func (s *cachedStorage[T]) begin() error {
+	s.closing.Lock()
+	defer s.closing.Unlock()
+	if s.closed {
+		return storage.ErrClosed
+	}
+	s.queuing.Add(1)
+	return nil
+}
+
+// appends the write to the write-ahead log and notes where it ends, returns where to roll it back to
+func (s *cachedStorage[T]) log(toCache *write[T]) (int64, error) {
+	if s.wal == nil {
+		return 0, nil
+	}
+	record, err := encodeWrite(s.codec, *toCache)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := s.wal.append(record)
+	if err != nil {
+		return offset, err
+	}
+	toCache.logged = offset + int64(len(record))
+	return offset, nil
+}
+
+// hands the write to the write routine, or overflows as configured
+func (s *cachedStorage[T]) queue(ctx context.Context, toCache write[T], apply func()) error {
+	s.progress.enqueue()
+	if s.spill != nil && s.spill.pending() {
+		return s.spillWrite(toCache, apply)
+	}
+	select {
+	case s.toCache <- toCache:
+		apply()
+		return nil
+	default:
+	}
+	switch s.config.Overflow {
+	case storage.OverflowFailFast:
+		s.progress.complete(1)
+		return storage.ErrQueueFull
+	case storage.OverflowDropOldest:
+		// the lock keeps other writers out, only the write routine takes from the queue meanwhile
+		for {
+			select {
+			case s.toCache <- toCache:
+				apply()
+				return nil
+			case dropped := <-s.toCache:
+				s.drop(dropped)
+			}
+		}
+	case storage.OverflowSpill:
+		return s.spillWrite(toCache, apply)
+	}
+	select {
+	case s.toCache <- toCache:
+		apply()
+		return nil
+	case <-ctx.Done():
+		s.progress.complete(1)
+		return ctx.Err()
+	case <-s.ctx.Done():
+		s.progress.complete(1)
+		return storage.ErrClosed
+	}
+}
+
+func (s *cachedStorage[T]) spillWrite(toCache write[T], apply func()) error {
+	record, err := encodeWrite(s.codec, toCache)
+	if err == nil {
+		err = s.spill.append(record, toCache.logged)
+	}
+	if err != nil {
+		s.progress.complete(1)
+		return err
+	}
+	apply()
+	return nil
+}
+
+// the dropped units leave the cache unless rewritten since, the cold storage only has older values
+func (s *cachedStorage[T]) drop(dropped write[T]) {
+	if len(dropped.units) > 0 {
+		queued := make(map[*unit[T]]bool, len(dropped.units))
+		for _, u := range dropped.units {
+			queued[u] = true
+			if u.SetPersisted() {
+				s.stats.unpersisted.Add(-1)
+			}
+		}
+		s.removeWhere(indexes(dropped.units), func(u *unit[T]) bool {
+			return queued[u]
+		})
+	}
+	// the cold storage keeps them, lookups may reach it again
+	s.tombstones.land(dropped.deletes())
+	s.progress.complete(1)
+	s.config.OnError(&storage.WriteError{Indexes: append(indexes(dropped.units), dropped.deleted...), Err: storage.ErrQueueFull})
+}
+
+// hands the spilled writes to the write routine once the queue is empty, so they keep their order
+func (s *cachedStorage[T]) unspill(ctx context.Context) {
+	if s.spill == nil || len(s.toCache) > 0 {
+		return
+	}
+	data, count, logged, err := s.spill.take()
+	if count == 0 {
+		return
+	}
+	var pending []write[T]
+	if err == nil {
+		pending, _, err = decodeWrites(s.codec, data, s.spilledUnit)
+	}
+	if err != nil {
+		s.config.OnError(fmt.Errorf("golfu: reading spilled writes: %w", err))
+	}
+	s.write(ctx, pending)
+	s.checkpoint(ctx, logged)
+	s.progress.complete(count)
+}
+
+// cuts the write-ahead log up to logged once the writes before it are persisted, the write routine
+// persists them in the order they were logged; a write interrupted by ctx may not be
+func (s *cachedStorage[T]) checkpoint(ctx context.Context, logged int64) {
+	if s.wal == nil || logged == 0 || ctx.Err() != nil {
+		return
+	}
+	if err := s.wal.cut(logged); err != nil {
+		s.config.OnError(fmt.Errorf("golfu: cutting the write-ahead log: %w", err))
 	}
-	s.toCache <- toCache
+}
+
+// queues again what the write-ahead log held when the cache starts, the records stay in it until persisted
+func (s *cachedStorage[T]) replay(data []byte) error {
+	pending, decoded, err := decodeWrites(s.codec, data, func(u *unit[T]) *unit[T] {
+		// the versions of the previous process mean nothing to this one
+		u.version = nextVersion()
+		if u.ttl > 0 {
+			s.expiring.Store(true)
+		}
+		return u
+	})
+	if err != nil {
+		// a record torn by a crash while appending it, later ones must not follow it
+		s.config.OnError(fmt.Errorf("golfu: replaying the write-ahead log: %w", err))
+		if err := s.wal.rollback(int64(decoded)); err != nil {
+			return err
+		}
+	}
+	for i := range pending {
+		w := &pending[i]
+		w.version = nextVersion()
+		s.stats.unpersisted.Add(int64(len(w.units)))
+		s.progress.enqueue()
+		if len(w.units) > 0 {
+			s.cache(w.units, nil)
+			s.tombstones.remove(indexes(w.units))
+		} else {
+			s.remove(w.deleted)
+			s.tombstones.add(w.deleted, w.version)
+			s.negatives.add(w.deleted, time.Now())
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// the log may hold more than the queue while the cold storage is down, the constructor does not wait
+	// for it; the writes queued meanwhile wait for the ordering lock, behind the logged ones
+	s.ordering <- struct{}{}
+	queued := s.spawn(func() {
+		defer func() { <-s.ordering }()
+		for i, w := range pending {
+			select {
+			case s.toCache <- w:
+			case <-s.ctx.Done():
+				s.progress.complete(uint64(len(pending) - i))
+				return
+			}
+		}
+	})
+	if !queued {
+		<-s.ordering
+		return storage.ErrClosed
+	}
+	return nil
+}
+
+// the cached unit when it still is the spilled one, the decoded one to persist otherwise
+func (s *cachedStorage[T]) spilledUnit(decoded *unit[T]) *unit[T] {
+	if u, ok := s.units.lookup(decoded.Index()); ok && u.version == decoded.version {
+		return u
+	}
+	return decoded
+}
+
+func (s *cachedStorage[T]) Backlog() int {
+	return int(s.progress.pending())
+}
+
+func (s *cachedStorage[T]) Stats() storage.Stats {
+	return storage.Stats{
+		Hits:           s.stats.hits.Load(),
+		Misses:         s.stats.misses.Load(),
+		ColdGets:       s.stats.coldGets.Load(),
+		ColdGetErrors:  s.stats.coldGetErrors.Load(),
+		ColdSetBatches: s.stats.coldSetBatches.Load(),
+		ColdSetErrors:  s.stats.coldSetErrors.Load(),
+		Evicted:        s.stats.evicted.Load(),
+		Expired:        s.stats.expired.Load(),
+		Size:           s.units.len(),
+		Bytes:          s.bytes.Load(),
+		Unpersisted:    int(s.stats.unpersisted.Load()),
+		QueueDepth:     len(s.toCache),
+	}
+}
+
+func (s *cachedStorage[T]) Flush(ctx context.Context) error {
+	return s.progress.wait(ctx, s.ctx.Done(), s.progress.target())
+}
+
+func (s *cachedStorage[T]) Close(ctx context.Context) error {
+	s.closing.Lock()
+	if s.closed {
+		s.closing.Unlock()
+		return storage.ErrClosed
+	}
+	s.closed = true
+	s.closing.Unlock()
+
+	// the writes being queued get their turn in the flush; waiting on a full queue they may never get it,
+	// once ctx is done they give up with the routines
+	queued := make(chan struct{})
+	go func() {
+		s.queuing.Wait()
+		close(queued)
+	}()
+	var err error
+	select {
+	case <-queued:
+		err = s.Flush(ctx)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.stop()
+	<-queued
+	// a spawn that saw the cache running is done adding to the routines
+	s.spawning.Lock()
+	s.spawning.Unlock()
+	s.routines.Wait()
+	if s.spill != nil {
+		err = errors.Join(err, s.spill.close())
+	}
+	if s.wal != nil {
+		err = errors.Join(err, s.wal.close())
+	}
+	return err
 }
 
 func (s *cachedStorage[T]) Get(indexes []string) (map[string]T, error) {
+	return s.GetCtx(context.Background(), indexes)
+}
+
+func (s *cachedStorage[T]) GetCtx(ctx context.Context, indexes []string) (map[string]T, error) {
 	var result = make(map[string]T)
 	var toFetch []string
-	cached := s.units.Get(indexes)
+	missing := 0
+	cached := s.units.read(indexes)
+	now := time.Now()
 	for _, c := range indexes {
-		if u, ok := cached[c]; ok {
+		// an expired unit is served until persisted, the cold storage would only hold an older value
+		if u, ok := cached[c]; ok && !(u.Expired(now) && u.IsPersisted()) {
 			result[c] = u.Read()
+			if s.stale(u, now) {
+				s.refresh(u)
+			}
+		} else if s.tombstones.has(c) || s.negatives.missing(c, now) {
+			missing++
 		} else {
 			toFetch = append(toFetch, c)
 		}
 	}
 
+	s.metrics.Hits(len(result) + missing)
 	if len(toFetch) == 0 {
 		return result, nil
 	}
+	s.metrics.Misses(len(toFetch))
 
-	persisted, err := s.cold.Get(toFetch)
-	if err != nil {
-		return nil, err
+	// only one cold storage lookup per index at a time, the other callers wait for its result;
+	// the lookup runs aside so the caller can stop waiting even if the cold storage ignores ctx
+	led, joined := s.flights.join(toFetch)
+	if len(led) > 0 {
+		fetchCtx, cancel := context.WithCancel(ctx)
+		unlink := context.AfterFunc(s.ctx, cancel)
+		fetching := s.spawn(func() {
+			defer cancel()
+			defer unlink()
+			s.fetch(fetchCtx, led)
+		})
+		if !fetching {
+			unlink()
+			cancel()
+			s.flights.land(led, nil, storage.ErrClosed)
+		}
+	}
+	var retry []string
+	for _, calls := range []map[string]*flight[T]{led, joined} {
+		for index, call := range calls {
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if call.err != nil {
+				if ctx.Err() == nil && isContextError(call.err) {
+					if s.ctx.Err() != nil {
+						return nil, storage.ErrClosed
+					}
+					// the leader of a joined flight gave up, that is no reason for this caller to
+					if _, own := led[index]; !own {
+						retry = append(retry, index)
+						continue
+					}
+				}
+				return nil, call.err
+			}
+			if call.found {
+				result[index] = call.value
+			}
+		}
 	}
+	if len(retry) > 0 {
+		retried, err := s.GetCtx(ctx, retry)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range retried {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
 
-	toCache := make([]T, len(persisted))
-	for k, v := range persisted {
-		result[k] = v
-		toCache = append(toCache, v)
+// looks the led flights up in the cold storage, caches what it found and lands them
+func (s *cachedStorage[T]) fetch(ctx context.Context, led map[string]*flight[T]) error {
+	start := time.Now()
+	persisted, err := s.coldGet(ctx, flightIndexes(led))
+	s.metrics.ColdGet(time.Since(start), err)
+	if err == nil {
+		found := make(map[string]T, len(persisted))
+		toCache := make([]T, 0, len(persisted))
+		for k, v := range persisted {
+			// deleted meanwhile, the cold storage only has it until the delete reaches it
+			if _, ok := led[k]; ok && !s.tombstones.has(k) {
+				found[k] = v
+				toCache = append(toCache, v)
+			}
+		}
+		persisted = found
+		s.SetPersisted(toCache)
+		var absent []string
+		for index := range led {
+			if _, ok := persisted[index]; !ok {
+				absent = append(absent, index)
+			}
+		}
+		s.negatives.add(absent, time.Now())
+		// a Set cached meanwhile already cleared them, before they were added
+		for _, index := range absent {
+			if _, ok := s.units.lookup(index); ok {
+				s.negatives.remove([]string{index})
+			}
+		}
 	}
+	s.flights.land(led, persisted, err)
+	return err
+}
 
-	s.Set(toCache)
-	return result, nil
+// loads the indexes not cached yet without counting reads, chunk by chunk; the indexes other callers are
+// already loading are left to them
+func (s *cachedStorage[T]) Prefetch(ctx context.Context, indexes []string) error {
+	var missing []string
+	now := time.Now()
+	for _, index := range indexes {
+		if u, ok := s.units.lookup(index); !ok || (u.Expired(now) && u.IsPersisted()) {
+			missing = append(missing, index)
+		}
+	}
+	for len(missing) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := missing[:min(len(missing), s.config.PrefetchChunkSize)]
+		missing = missing[len(chunk):]
+		if led, _ := s.flights.join(chunk); len(led) > 0 {
+			if err := s.fetch(ctx, led); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (s *cachedStorage[T]) evict(amount int) []T {
-	if amount <= 0 {
-		return []T{}
+// a persisted unit read often enough that is within the refresh-ahead share of its ttl
+func (s *cachedStorage[T]) stale(u *unit[T], now time.Time) bool {
+	if s.config.RefreshAhead <= 0 || u.ttl <= 0 || !u.IsPersisted() {
+		return false
 	}
-	s.units.SortByReadCount()
-	trashed := s.units.PopWhere(func(u *unit[T]) bool {
-		return u.IsPersisted()
-	}, amount)
-	s.units.ClearReadCounts()
-	return values(trashed)
+	if u.expiresAt.Sub(now) > time.Duration(float64(u.ttl)*s.config.RefreshAhead) {
+		return false
+	}
+	return s.units.of(u.Index()).units.ReadWriteCounts([]string{u.Index()})[u.Index()] >= s.config.RefreshMinReads
+}
+
+// reloads the unit in the background, as a flight so it happens once per index and misses meanwhile wait for it;
+// the reloaded value only replaces the unit if nothing changed it since
+func (s *cachedStorage[T]) refresh(u *unit[T]) {
+	index := u.Index()
+	led, _ := s.flights.join([]string{index})
+	if len(led) == 0 {
+		return
+	}
+	// a reader of u that is late to the refresh, the cache already has the refreshed unit
+	if cached, ok := s.units.lookup(index); ok && cached != u && !(cached.Expired(time.Now()) && cached.IsPersisted()) {
+		s.flights.land(led, map[string]T{index: cached.Read()}, nil)
+		return
+	}
+	refreshing := s.spawn(func() {
+		start := time.Now()
+		persisted, err := s.coldGet(s.ctx, []string{index})
+		s.metrics.ColdGet(time.Since(start), err)
+		if value, ok := persisted[index]; ok && err == nil && !s.tombstones.has(index) {
+			refreshed := toUnits([]persistable[T]{{value: value, isPersisted: true, ttl: u.ttl}})
+			s.cache(refreshed, func(old *unit[T]) bool {
+				return old == u
+			})
+		}
+		s.flights.land(led, persisted, err)
+	})
+	if !refreshing {
+		s.flights.land(led, nil, storage.ErrClosed)
+	}
+}
+
+// runs fn aside, Close waits for it like for the routines; false once the cache is stopped
+func (s *cachedStorage[T]) spawn(fn func()) bool {
+	s.spawning.Lock()
+	defer s.spawning.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.routines.Add(1)
+	go func() {
+		defer s.routines.Done()
+		fn()
+	}()
+	return true
+}
+
+func (s *cachedStorage[T]) coldGet(ctx context.Context, indexes []string) (map[string]T, error) {
+	if cold, ok := s.cold.(storage.ContextColdStorage[T]); ok {
+		return cold.GetCtx(ctx, indexes)
+	}
+	return s.cold.Get(indexes)
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// caches units, replace as in IndexedList.SetWhere
+func (s *cachedStorage[T]) cache(units []*unit[T], replace func(old *unit[T]) bool) {
+	replaced, skipped := s.units.cache(units, replace)
+	s.negatives.remove(indexes(units))
+	if s.weigh == nil {
+		return
+	}
+	ignored := make(map[*unit[T]]bool, len(skipped))
+	for _, u := range skipped {
+		ignored[u] = true
+	}
+	var added int64
+	for _, u := range units {
+		if !ignored[u] {
+			added += int64(s.weigh(u.Read()))
+		}
+	}
+	s.bytes.Add(added - s.weighValues(values(replaced)))
+}
+
+func (s *cachedStorage[T]) remove(indexes []string) {
+	s.removeWhere(indexes, nil)
+}
+
+func (s *cachedStorage[T]) removeWhere(indexes []string, predicate func(*unit[T]) bool) {
+	removed := s.units.remove(indexes, predicate)
+	s.bytes.Add(-s.weighValues(values(removed)))
+}
+
+func (s *cachedStorage[T]) weighValues(values []T) int64 {
+	if s.weigh == nil {
+		return 0
+	}
+	var total int64
+	for _, v := range values {
+		total += int64(s.weigh(v))
+	}
+	return total
 }
 
 type cachedStorage[T storage.Indexable] struct {
-	units     listop.IndexedList[*unit[T]]
-	cold      storage.ColdStorage[T]
-	maxUnits  int
-	ctx       context.Context
-	toCache   chan []persistable[T]
+	units  *shards[T]
+	cold   storage.ColdStorage[T]
+	config Config
+	stats  stats
+	// stats + the configured metrics
+	metrics storage.Metrics
+	flights *flights[T]
+	// nil without negative caching
+	negatives *negatives
+	// always on, unlike the negatives: they keep reads consistent with the deletes
+	tombstones *tombstones
+	ctx        context.Context
+	stop       context.CancelFunc
+	routines   sync.WaitGroup
+	// keeps spawn from adding to the routines once Close waits for them
+	spawning sync.Mutex
+	progress *progress
+	closing  sync.Mutex
+	closed   bool
+	// writes begun before Close, see begin
+	queuing sync.WaitGroup
+	// held while queuing a write, see enqueue
+	ordering chan struct{}
+	// held while writing to the cold storage, see writeThrough
+	persisting sync.Mutex
+	keys       *keyLocks
+	// set once a unit with a ttl has been cached, spares the sweeps otherwise
+	expiring  atomic.Bool
+	toCache   chan write[T]
 	newLength chan int
+	// nil without a weigher nor values implementing storage.Sizer
+	weigh func(T) int
+	// weight of the cached units
+	bytes atomic.Int64
+	// nil unless configured
+	codec storage.Codec[T]
+	spill *spill
+	wal   *wal
+}
+
+// nil, blocking forever, without a spill
+func (s *cachedStorage[T]) spilled() <-chan struct{} {
+	if s.spill == nil {
+		return nil
+	}
+	return s.spill.ready
 }
 
 func NewCachedStorage[T storage.Indexable](ctx context.Context, cold storage.ColdStorage[T], trash storage.Trash[T], maxUnits int) storage.CachedStorage[T] {
+	config := DefaultConfig()
+	config.MaxUnits = maxUnits
+	config.Trash = trash
+	cache, err := NewCachedStorageWithConfig(ctx, cold, config)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
+
+func NewCachedStorageWithConfig[T storage.Indexable](ctx context.Context, cold storage.ColdStorage[T], config Config) (storage.CachedStorage[T], error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var trash storage.Trash[T] = noopTrash[T]{}
+	if config.Trash != nil {
+		typed, ok := config.Trash.(storage.Trash[T])
+		if !ok {
+			return nil, fmt.Errorf("%w: trash %T does not accept the cached type", storage.ErrInvalidConfig, config.Trash)
+		}
+		trash = typed
+	}
+
+	var codec storage.Codec[T]
+	if config.Codec != nil {
+		typed, ok := config.Codec.(storage.Codec[T])
+		if !ok {
+			return nil, fmt.Errorf("%w: codec %T does not encode the cached type", storage.ErrInvalidConfig, config.Codec)
+		}
+		codec = typed
+	}
+	weigh, ok := config.Weigher.(func(T) int)
+	if config.Weigher != nil && !ok {
+		return nil, fmt.Errorf("%w: weigher %T does not weigh the cached type", storage.ErrInvalidConfig, config.Weigher)
+	}
+	if _, sized := any(*new(T)).(storage.Sizer); weigh == nil && sized {
+		weigh = func(value T) int {
+			return any(value).(storage.Sizer).Size()
+		}
+	}
+	if config.MaxBytes > 0 && weigh == nil {
+		return nil, fmt.Errorf("%w: max bytes needs a weigher or values implementing storage.Sizer", storage.ErrInvalidConfig)
+	}
+	var spilled *spill
+	if config.Overflow == storage.OverflowSpill {
+		var err error
+		if spilled, err = openSpill(config.SpillPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var log *wal
+	var logged []byte
+	if config.WALPath != "" {
+		var err error
+		if log, logged, err = openWAL(config.WALPath); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, stop := context.WithCancel(ctx)
 	cache := &cachedStorage[T]{
-		units:     listop.NewIndexedList[*unit[T]](),
-		cold:      cold,
-		maxUnits:  maxUnits,
-		ctx:       ctx,
-		toCache:   make(chan []persistable[T], 100),
-		newLength: make(chan int, 100),
+		wal:        log,
+		weigh:      weigh,
+		codec:      codec,
+		spill:      spilled,
+		units:      newShards[T](config.Shards, config.policyCapacity(), config.EvictionPolicy),
+		cold:       cold,
+		config:     config,
+		ctx:        ctx,
+		stop:       stop,
+		progress:   newProgress(),
+		flights:    newFlights[T](),
+		negatives:  newNegatives(config.NegativeTTL, config.NegativeMaxUnits),
+		tombstones: newTombstones(),
+		ordering:   make(chan struct{}, 1),
+		keys:       newKeyLocks(),
+		toCache:    make(chan write[T], config.WriteQueueSize),
+		newLength:  make(chan int, config.EvictionQueueSize),
 	}
+	cache.metrics = multiMetrics{&cache.stats, config.Metrics}
+	cache.expiring.Store(config.TTL > 0)
 	cache.Start(ctx, trash)
-	return cache
+	if log != nil {
+		if err := cache.replay(logged); err != nil {
+			stop()
+			cache.routines.Wait()
+			return nil, errors.Join(err, log.close())
+		}
+	}
+	return cache, nil
 }
+
+type noopTrash[T storage.Indexable] struct{}
+
+func (noopTrash[T]) Trash([]T) {}
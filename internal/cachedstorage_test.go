@@ -1,17 +1,26 @@
 package internal_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/JGpGH/golfu/internal"
+	"github.com/JGpGH/golfu/policy"
 	"github.com/JGpGH/golfu/storage"
 )
 
 type TestColdStorage[T storage.Indexable] struct {
 	setted  chan T
 	deleted chan T
+	removed chan string
 	inner   map[string]T
 }
 
@@ -19,6 +28,7 @@ func NewTestColdStorage[T storage.Indexable]() *TestColdStorage[T] {
 	return &TestColdStorage[T]{
 		setted:  make(chan T, 100),
 		deleted: make(chan T, 100),
+		removed: make(chan string, 100),
 		inner:   make(map[string]T),
 	}
 }
@@ -38,6 +48,13 @@ func (tcs *TestColdStorage[T]) Get(keys []string) (map[string]T, error) {
 	return tcs.inner, nil
 }
 
+func (tcs *TestColdStorage[T]) Delete(keys []string) error {
+	for _, key := range keys {
+		tcs.removed <- key
+	}
+	return nil
+}
+
 func (tcs *TestColdStorage[T]) Trash(ins []T) {
 	for _, in := range ins {
 		tcs.deleted <- in
@@ -205,3 +222,1570 @@ func TestStorageEvictsUntil20PercentUnderMax(t *testing.T) {
 		t.Error("Eviction of 20% under max failed")
 	}
 }
+
+func TestStorageFlushWaitsForPersistence(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+	})
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("3", 3),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 3 {
+		t.Error("Expected 3 persisted values after flush, got ", len(cold.setted))
+	}
+}
+
+func TestStorageCloseDrainsQueue(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	for i := 0; i < 20; i++ {
+		cache.Set([]storage.Indexed[int]{storage.NewIndexed(strconv.Itoa(i), i)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 20 {
+		t.Error("Expected 20 persisted values after close, got ", len(cold.setted))
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("21", 21)})
+	if err := cache.Flush(ctx); err != nil {
+		t.Error(err)
+	}
+	if len(cold.setted) != 20 {
+		t.Error("Set after close reached the cold storage")
+	}
+	if err := cache.Close(ctx); err != storage.ErrClosed {
+		t.Error("Expected ErrClosed on second close, got ", err)
+	}
+}
+
+type FailingColdStorage[T storage.Indexable] struct {
+	*TestColdStorage[T]
+	failures atomic.Int32
+}
+
+func (fcs *FailingColdStorage[T]) Set(ins []storage.Readonly[T]) error {
+	if fcs.failures.Add(-1) >= 0 {
+		return errors.New("cold storage unavailable")
+	}
+	return fcs.TestColdStorage.Set(ins)
+}
+
+func TestStorageCloseGivesUpWithItsContext(t *testing.T) {
+	cold := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.failures.Store(1 << 30)
+	config := internal.DefaultConfig()
+	config.WriteQueueSize = 1
+	config.OnError = func(error) {}
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache.Set([]storage.Indexed[int]{storage.NewIndexed(strconv.Itoa(i), i)})
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- cache.Close(ctx) }()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("Expected Close to give up with its context, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to return once its context is done")
+	}
+	wg.Wait()
+	if err := cache.SetCtx(context.Background(), []storage.Indexed[int]{storage.NewIndexed("4", 4)}); !errors.Is(err, storage.ErrClosed) {
+		t.Error("Expected ErrClosed once closed, got ", err)
+	}
+}
+
+func TestStorageRetriesFailedWrites(t *testing.T) {
+	cold := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.failures.Store(3)
+	reported := make(chan error, 10)
+	config := internal.DefaultConfig()
+	config.Backoff = storage.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2}
+	config.OnError = func(err error) { reported <- err }
+	config.MaxUnits = 10
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 2 {
+		t.Error("Expected 2 persisted values after retries, got ", len(cold.setted))
+	}
+	if len(reported) != 3 {
+		t.Fatal("Expected 3 reported errors, got ", len(reported))
+	}
+	var writeErr *storage.WriteError
+	if err := <-reported; !errors.As(err, &writeErr) || writeErr.Attempt != 1 || len(writeErr.Indexes) != 2 {
+		t.Error("Unexpected reported error ", err)
+	}
+}
+
+func TestStorageDoesNotEvictUnpersisted(t *testing.T) {
+	cold := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.failures.Store(1 << 30)
+	config := internal.DefaultConfig()
+	config.Backoff = storage.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	config.MaxUnits = 2
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+		storage.NewIndexed("3", 3),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := cold.CollectDeleted(ctx, 1)
+	if len(r) != 0 {
+		t.Error("Evicted units that never reached the cold storage")
+	}
+	if err := cache.Close(ctx); err == nil {
+		t.Error("Expected close to give up on a cold storage that keeps failing")
+	}
+}
+
+func TestStorageDeletePropagatesToCold(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+	})
+	cache.Delete([]string{"1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.removed) != 1 || <-cold.removed != "1" {
+		t.Error("Expected a tombstone for 1 in the cold storage")
+	}
+	res, err := cache.Get([]string{"1", "2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok := res["1"]; ok {
+		t.Error("Deleted value still returned")
+	}
+	if res["2"].Value != 2 {
+		t.Error("Expected 2 to survive the delete")
+	}
+}
+
+// cold storage without Delete
+type UndeletableColdStorage[T storage.Indexable] struct {
+	cold *TestColdStorage[T]
+}
+
+func (ucs UndeletableColdStorage[T]) Get(keys []string) (map[string]T, error) {
+	return ucs.cold.Get(keys)
+}
+
+func (ucs UndeletableColdStorage[T]) Set(ins []storage.Readonly[T]) error {
+	return ucs.cold.Set(ins)
+}
+
+func TestStorageKeepsDeletesTheColdStorageCannotTake(t *testing.T) {
+	inner := NewTestColdStorage[storage.Indexed[int]]()
+	inner.inner["1"] = storage.NewIndexed("1", 1)
+	errs := make(chan error, 10)
+	config := internal.DefaultConfig()
+	config.OnError = func(err error) { errs <- err }
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), UndeletableColdStorage[storage.Indexed[int]]{inner}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Delete([]string{"1"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, storage.ErrDeleteUnsupported) {
+		t.Fatal("Expected ErrDeleteUnsupported to be reported, got ", err)
+	}
+	if res, _ := cache.Get([]string{"1"}); len(res) != 0 {
+		t.Fatal("Expected the value to stay deleted in the cache, got ", res)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 2)})
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 2 {
+		t.Fatal("Expected a set after the delete to be read, got ", res)
+	}
+}
+
+func TestStorageInvalidateStaysLocal(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cold.inner["1"] = storage.NewIndexed("1", 10)
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate([]string{"1"})
+	res, err := cache.Get([]string{"1"})
+	if err != nil {
+		t.Error(err)
+	}
+	if res["1"].Value != 10 {
+		t.Error("Expected the cold storage value after invalidation, got ", res["1"].Value)
+	}
+	if len(cold.removed) != 0 {
+		t.Error("Invalidate reached the cold storage")
+	}
+}
+
+func TestStorageExpiredEntriesFallThrough(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.ExpiryInterval = time.Hour
+	config.MaxUnits = 10
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithTTL([]storage.Indexed[int]{storage.NewIndexed("1", 1)}, 20*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cold.inner["1"] = storage.NewIndexed("1", 10)
+	res, err := cache.Get([]string{"1"})
+	if err != nil {
+		t.Error(err)
+	}
+	if res["1"].Value != 1 {
+		t.Error("Expected the cached value before expiry, got ", res["1"].Value)
+	}
+	time.Sleep(30 * time.Millisecond)
+	res, err = cache.Get([]string{"1"})
+	if err != nil {
+		t.Error(err)
+	}
+	if res["1"].Value != 10 {
+		t.Error("Expected the cold storage value after expiry, got ", res["1"].Value)
+	}
+}
+
+func TestStorageSweepsExpiredEntries(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.ExpiryInterval = 10 * time.Millisecond
+	config.MaxUnits = 10
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithTTL([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+	}, 20*time.Millisecond)
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("3", 3)})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	r := cold.CollectDeleted(ctx, 2)
+	if len(r) != 2 {
+		t.Fatal("Expected 2 expired values, got ", len(r))
+	}
+	for _, in := range r {
+		if in.Value == 3 {
+			t.Error("Swept a value without ttl")
+		}
+	}
+}
+
+func TestConfigRejectsInvalidOptions(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.EvictionHeadroom = 1.5
+	config.BatchSize = -1
+	if _, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config); !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig, got ", err)
+	}
+	config = internal.DefaultConfig()
+	config.Trash = NewTestColdStorage[storage.Indexed[string]]()
+	if _, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config); !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig for a trash of another type, got ", err)
+	}
+	config = internal.DefaultConfig()
+	config.Overflow = storage.OverflowSpill
+	if _, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config); !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig for spilling without a path nor codec, got ", err)
+	}
+	config = internal.DefaultConfig()
+	config.MaxBytes = 100
+	if _, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config); !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig for a max bytes without weigher, got ", err)
+	}
+	config = internal.DefaultConfig()
+	config.RefreshAhead = 1
+	if _, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config); !errors.Is(err, storage.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig for refreshing ahead over the whole ttl, got ", err)
+	}
+}
+
+type CountingColdStorage[T storage.Indexable] struct {
+	*TestColdStorage[T]
+	calls atomic.Int32
+	gets  atomic.Int32
+}
+
+func (ccs *CountingColdStorage[T]) Get(keys []string) (map[string]T, error) {
+	ccs.gets.Add(1)
+	return ccs.TestColdStorage.Get(keys)
+}
+
+func (ccs *CountingColdStorage[T]) Set(ins []storage.Readonly[T]) error {
+	ccs.calls.Add(1)
+	return ccs.TestColdStorage.Set(ins)
+}
+
+func TestStorageBatchesWritesWithinFlushInterval(t *testing.T) {
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	config := internal.DefaultConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.BatchSize = 4
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		cache.Set([]storage.Indexed[int]{storage.NewIndexed(strconv.Itoa(i), i)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 8 {
+		t.Error("Expected 8 persisted values, got ", len(cold.setted))
+	}
+	if calls := cold.calls.Load(); calls != 2 {
+		t.Error("Expected 2 batched cold storage writes, got ", calls)
+	}
+}
+
+func TestStorageCoalescesWritesToTheSameIndex(t *testing.T) {
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	config := internal.DefaultConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.BatchSize = 3
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		cache.Set([]storage.Indexed[int]{storage.NewIndexed("hot", i)})
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("gone", 0)})
+	cache.Delete([]string{"gone"})
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := cold.calls.Load(); calls != 1 {
+		t.Error("Expected a single cold storage write, got ", calls)
+	}
+	if len(cold.setted) != 1 {
+		t.Fatal("Expected only the last value of hot to be persisted, got ", len(cold.setted))
+	}
+	if hot := <-cold.setted; hot.Value != 49 {
+		t.Error("Expected the last value of hot, got ", hot.Value)
+	}
+	if removed := <-cold.removed; removed != "gone" {
+		t.Error("Expected gone to be deleted, got ", removed)
+	}
+	if unpersisted := cache.Stats().Unpersisted; unpersisted != 0 {
+		t.Error("Expected nothing left unpersisted, got ", unpersisted)
+	}
+}
+
+func TestStorageEvictsWithPolicy(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.MaxUnits = 4
+	config.EvictionHeadroom = 0
+	config.EvictionPolicy = policy.NewLRU
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+		storage.NewIndexed("3", 3),
+		storage.NewIndexed("4", 4),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]string{"1", "2", "3"}); err != nil {
+		t.Error(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("5", 5)})
+	r := cold.CollectDeleted(ctx, 1)
+	if len(r) != 1 || r[0].Value != 4 {
+		t.Error("Expected the least recently used value to be evicted, got ", r)
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	cold := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.failures.Store(1)
+	cold.inner["3"] = storage.NewIndexed("3", 3)
+	config := internal.DefaultConfig()
+	config.Backoff = storage.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	config.MaxUnits = 10
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{
+		storage.NewIndexed("1", 1),
+		storage.NewIndexed("2", 2),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats := cache.Stats()
+	if stats.ColdSetBatches != 2 || stats.ColdSetErrors != 1 {
+		t.Error("Unexpected write stats ", stats)
+	}
+	if stats.Size != 2 || stats.Unpersisted != 0 {
+		t.Error("Unexpected size stats ", stats)
+	}
+	if _, err := cache.Get([]string{"1", "2", "3"}); err != nil {
+		t.Error(err)
+	}
+	stats = cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.ColdGets != 1 {
+		t.Error("Unexpected lookup stats ", stats)
+	}
+}
+
+type SlowColdStorage[T storage.Indexable] struct {
+	*TestColdStorage[T]
+	release chan struct{}
+	gets    atomic.Int32
+}
+
+func (scs *SlowColdStorage[T]) Get(keys []string) (map[string]T, error) {
+	scs.gets.Add(1)
+	<-scs.release
+	return scs.TestColdStorage.Get(keys)
+}
+
+func TestStorageCoalescesConcurrentMisses(t *testing.T) {
+	cold := &SlowColdStorage[storage.Indexed[int]]{
+		TestColdStorage: NewTestColdStorage[storage.Indexed[int]](),
+		release:         make(chan struct{}),
+	}
+	cold.inner["1"] = storage.NewIndexed("1", 1)
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	var wg sync.WaitGroup
+	results := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := cache.Get([]string{"1"})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- res["1"].Value
+		}()
+	}
+	for cold.gets.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(cold.release)
+	wg.Wait()
+	close(results)
+	for v := range results {
+		if v != 1 {
+			t.Error("Expected every waiter to get 1, got ", v)
+		}
+	}
+	if gets := cold.gets.Load(); gets != 1 {
+		t.Error("Expected a single cold storage lookup, got ", gets)
+	}
+}
+
+func TestStorageReadsItsOwnWrites(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cold.inner["1"] = storage.NewIndexed("1", 10)
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	for i := 0; i < 50; i++ {
+		cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", i)})
+		res, err := cache.Get([]string{"1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res["1"].Value != i {
+			t.Fatal("Expected to read ", i, " right after setting it, got ", res["1"].Value)
+		}
+	}
+	cache.Delete([]string{"1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageReadsDoNotWriteBack(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cold.inner["1"] = storage.NewIndexed("1", 1)
+	cold.inner["2"] = storage.NewIndexed("2", 2)
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	for i := 0; i < 3; i++ {
+		res, err := cache.Get([]string{"1", "2", "3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res["1"].Value != 1 || res["2"].Value != 2 {
+			t.Error("Get failed")
+		}
+		if _, ok := res["3"]; ok {
+			t.Error("Expected 3 to be missing")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 0 {
+		t.Error("Expected no write to the cold storage for pure reads, got ", len(cold.setted))
+	}
+	stats := cache.Stats()
+	if stats.ColdSetBatches != 0 || stats.Hits != 4 || stats.Unpersisted != 0 {
+		t.Error("Unexpected stats ", stats)
+	}
+}
+
+// cold storage that only answers once the context given to it is done
+type BlockingColdStorage[T storage.Indexable] struct {
+	sets atomic.Int32
+	// GetCtx calls not returned yet
+	getting atomic.Int32
+}
+
+func (bcs *BlockingColdStorage[T]) Get([]string) (map[string]T, error) {
+	return nil, errors.New("use GetCtx")
+}
+
+func (bcs *BlockingColdStorage[T]) Set([]storage.Readonly[T]) error {
+	return errors.New("use SetCtx")
+}
+
+func (bcs *BlockingColdStorage[T]) GetCtx(ctx context.Context, _ []string) (map[string]T, error) {
+	bcs.getting.Add(1)
+	defer bcs.getting.Add(-1)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (bcs *BlockingColdStorage[T]) SetCtx(ctx context.Context, _ []storage.Readonly[T]) error {
+	bcs.sets.Add(1)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStorageGetCtxStopsWaiting(t *testing.T) {
+	cold := &SlowColdStorage[storage.Indexed[int]]{
+		TestColdStorage: NewTestColdStorage[storage.Indexed[int]](),
+		release:         make(chan struct{}),
+	}
+	defer close(cold.release)
+	cache := internal.NewCachedStorage(context.Background(), cold, cold, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cache.GetCtx(ctx, []string{"1"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	blocking := &BlockingColdStorage[storage.Indexed[int]]{}
+	other := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), blocking, nil, 10)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := other.GetCtx(ctx, []string{"1"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the cold storage to get the deadline, got %v", err)
+	}
+}
+
+func TestStorageCloseWaitsForBackgroundLookups(t *testing.T) {
+	cold := &BlockingColdStorage[storage.Indexed[int]]{}
+	cache := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), cold, nil, 10)
+	got := make(chan error, 1)
+	go func() {
+		_, err := cache.Get([]string{"1"})
+		got <- err
+	}()
+	for cold.getting.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cache.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if getting := cold.getting.Load(); getting != 0 {
+		t.Fatal("Expected the lookup to be over once closed, got ", getting)
+	}
+	if err := <-got; !errors.Is(err, storage.ErrClosed) {
+		t.Fatal("Expected the Get to fail with ErrClosed, got ", err)
+	}
+	if _, err := cache.Get([]string{"1"}); !errors.Is(err, storage.ErrClosed) {
+		t.Fatal("Expected a Get missing once closed to fail with ErrClosed, got ", err)
+	}
+}
+
+func TestStorageSetCtxGivesUpOnFullQueue(t *testing.T) {
+	cold := &BlockingColdStorage[storage.Indexed[int]]{}
+	config := internal.DefaultConfig()
+	config.WriteQueueSize = 1
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	for cold.sets.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("2", 2)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cache.SetCtx(ctx, []storage.Indexed[int]{storage.NewIndexed("3", 3)}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if size := cache.Stats().Size; size != 2 {
+		t.Fatalf("expected the rejected value to stay out of the cache, got %d units", size)
+	}
+
+	// the write routine is cancelled on close, the blocked cold storage write sees it
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cache.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected close to time out, got %v", err)
+	}
+	if err := cache.SetCtx(context.Background(), []storage.Indexed[int]{storage.NewIndexed("4", 4)}); !errors.Is(err, storage.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// keeps what is set, deletes once the gate opens
+type SlowDeleteColdStorage struct {
+	lock  sync.Mutex
+	inner map[string]storage.Indexed[int]
+	gate  chan struct{}
+}
+
+func (sdc *SlowDeleteColdStorage) Get(keys []string) (map[string]storage.Indexed[int], error) {
+	sdc.lock.Lock()
+	defer sdc.lock.Unlock()
+	res := make(map[string]storage.Indexed[int])
+	for _, key := range keys {
+		if v, ok := sdc.inner[key]; ok {
+			res[key] = v
+		}
+	}
+	return res, nil
+}
+
+func (sdc *SlowDeleteColdStorage) Set(ins []storage.Readonly[storage.Indexed[int]]) error {
+	sdc.lock.Lock()
+	defer sdc.lock.Unlock()
+	for _, in := range ins {
+		sdc.inner[in.Read().Index()] = in.Read()
+	}
+	return nil
+}
+
+func (sdc *SlowDeleteColdStorage) Delete(keys []string) error {
+	<-sdc.gate
+	sdc.lock.Lock()
+	defer sdc.lock.Unlock()
+	for _, key := range keys {
+		delete(sdc.inner, key)
+	}
+	return nil
+}
+
+func TestStorageReadsItsOwnDeletes(t *testing.T) {
+	cold := &SlowDeleteColdStorage{inner: make(map[string]storage.Indexed[int]), gate: make(chan struct{})}
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, internal.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cache.Delete([]string{"1"})
+	if res, _ := cache.Get([]string{"1"}); len(res) != 0 {
+		t.Fatal("Expected the delete to hide the value the cold storage still has, got ", res)
+	}
+	close(cold.gate)
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cache.Get([]string{"1"}); len(res) != 0 {
+		t.Fatal("Expected the value to stay deleted once the delete is persisted, got ", res)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 2)})
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 2 {
+		t.Fatal("Expected a set after the delete to be read, got ", res)
+	}
+}
+
+// cold storage whose writes wait for the gate to be closed
+type GatedColdStorage[T storage.Indexable] struct {
+	*TestColdStorage[T]
+	gate    chan struct{}
+	started atomic.Int32
+}
+
+func NewGatedColdStorage[T storage.Indexable]() *GatedColdStorage[T] {
+	return &GatedColdStorage[T]{TestColdStorage: NewTestColdStorage[T](), gate: make(chan struct{})}
+}
+
+func (gcs *GatedColdStorage[T]) Set(ins []storage.Readonly[T]) error {
+	gcs.started.Add(1)
+	<-gcs.gate
+	return gcs.TestColdStorage.Set(ins)
+}
+
+// fills the write routine and a queue of one, then returns what the error handler receives
+func fillQueue(t *testing.T, cold *GatedColdStorage[storage.Indexed[int]], config internal.Config) (storage.CachedStorage[storage.Indexed[int]], chan error) {
+	errs := make(chan error, 10)
+	config.WriteQueueSize = 1
+	config.OnError = func(err error) { errs <- err }
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	for cold.started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("2", 2)})
+	return cache, errs
+}
+
+func TestStorageOverflowFailsFast(t *testing.T) {
+	cold := NewGatedColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.Overflow = storage.OverflowFailFast
+	cache, errs := fillQueue(t, cold, config)
+
+	if err := cache.SetCtx(context.Background(), []storage.Indexed[int]{storage.NewIndexed("3", 3)}); !errors.Is(err, storage.ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("4", 4)})
+	var writeErr *storage.WriteError
+	if err := <-errs; !errors.As(err, &writeErr) || !errors.Is(err, storage.ErrQueueFull) || writeErr.Indexes[0] != "4" {
+		t.Fatalf("expected Set to report the full queue, got %v", err)
+	}
+	if backlog := cache.Backlog(); backlog != 2 {
+		t.Fatalf("expected a backlog of 2, got %d", backlog)
+	}
+	close(cold.gate)
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if backlog := cache.Backlog(); backlog != 0 {
+		t.Fatalf("expected the backlog to be drained, got %d", backlog)
+	}
+}
+
+func TestStorageOverflowDropsOldest(t *testing.T) {
+	cold := NewGatedColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.Overflow = storage.OverflowDropOldest
+	cache, errs := fillQueue(t, cold, config)
+
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("3", 3)})
+	var writeErr *storage.WriteError
+	if err := <-errs; !errors.As(err, &writeErr) || writeErr.Indexes[0] != "2" {
+		t.Fatalf("expected the write of 2 to be dropped, got %v", err)
+	}
+	if res, _ := cache.Get([]string{"2", "3"}); len(res) != 1 || res["3"].Value != 3 {
+		t.Fatalf("expected only the kept write to be cached, got %v", res)
+	}
+	close(cold.gate)
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	setted := cold.CollectSetted(ctx, 3)
+	if len(setted) != 2 || setted[0].Value != 1 || setted[1].Value != 3 {
+		t.Fatalf("expected 1 and 3 to be persisted, got %v", setted)
+	}
+	if unpersisted := cache.Stats().Unpersisted; unpersisted != 0 {
+		t.Fatalf("expected nothing left unpersisted, got %d", unpersisted)
+	}
+}
+
+func TestStorageOverflowSpillsToDisk(t *testing.T) {
+	cold := NewGatedColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.Overflow = storage.OverflowSpill
+	config.SpillPath = t.TempDir() + "/spill"
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	cache, _ := fillQueue(t, cold, config)
+
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("3", 3)})
+	cache.Delete([]string{"1"})
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("3", 30)})
+	if backlog := cache.Backlog(); backlog != 5 {
+		t.Fatalf("expected a backlog of 5, got %d", backlog)
+	}
+	close(cold.gate)
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// the spilled writes are read back together, 3 only gets persisted with its last value
+	setted := cold.CollectSetted(ctx, 4)
+	expected := []int{1, 2, 30}
+	if len(setted) != len(expected) {
+		t.Fatalf("expected %v to be persisted in order, got %v", expected, setted)
+	}
+	for i, v := range expected {
+		if setted[i].Value != v {
+			t.Fatalf("expected %v to be persisted in order, got %v", expected, setted)
+		}
+	}
+	if removed := <-cold.removed; removed != "1" {
+		t.Fatalf("expected the spilled delete of 1, got %s", removed)
+	}
+	if unpersisted := cache.Stats().Unpersisted; unpersisted != 0 {
+		t.Fatalf("expected nothing left unpersisted, got %d", unpersisted)
+	}
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageSetSyncCachesOnlyOnSuccess(t *testing.T) {
+	cold := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.failures.Store(1)
+	cache := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), cold, nil, 10)
+	if err := cache.SetSync([]storage.Indexed[int]{storage.NewIndexed("1", 1)}); err == nil {
+		t.Fatal("Expected the cold storage error")
+	}
+	if res, _ := cache.Get([]string{"1"}); len(res) != 0 {
+		t.Fatal("Expected the failed write to stay out of the cache, got ", res)
+	}
+	if err := cache.SetSync([]storage.Indexed[int]{storage.NewIndexed("1", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 1 {
+		t.Fatal("Expected the value to be persisted once SetSync returns")
+	}
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 1 {
+		t.Fatal("Expected the written through value to be cached, got ", res)
+	}
+	if stats := cache.Stats(); stats.Unpersisted != 0 || cache.Backlog() != 0 {
+		t.Fatal("Expected nothing queued, got ", stats.Unpersisted, cache.Backlog())
+	}
+}
+
+func TestStorageWriteThroughSupersedesQueuedWrites(t *testing.T) {
+	cold := NewGatedColdStorage[storage.Indexed[int]]()
+	cache := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), cold, nil, 10)
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("0", 0)})
+	for cold.started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	written := make(chan error)
+	go func() {
+		written <- cache.SetSync([]storage.Indexed[int]{storage.NewIndexed("1", 2)})
+	}()
+	close(cold.gate)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the queued write either went first or was skipped, it never lands after the synchronous one
+	var last storage.Indexed[int]
+	for len(cold.setted) > 0 {
+		if v := <-cold.setted; v.Index() == "1" {
+			last = v
+		}
+	}
+	if last.Value != 2 {
+		t.Fatal("Expected the written through value to be the last persisted, got ", last.Value)
+	}
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 2 {
+		t.Fatal("Expected the written through value to be cached, got ", res)
+	}
+	if unpersisted := cache.Stats().Unpersisted; unpersisted != 0 {
+		t.Fatal("Expected nothing left unpersisted, got ", unpersisted)
+	}
+}
+
+type VersionedValue struct {
+	index   string
+	version uint64
+}
+
+func (v VersionedValue) Index() string {
+	return v.index
+}
+
+func (v VersionedValue) Version() uint64 {
+	return v.version
+}
+
+// cold storage checking versions itself, as a database would in a transaction
+type VersioningColdStorage struct {
+	*TestColdStorage[VersionedValue]
+	lock sync.Mutex
+}
+
+func (vcs *VersioningColdStorage) CompareAndSet(index string, expectedVersion uint64, value VersionedValue) error {
+	vcs.lock.Lock()
+	defer vcs.lock.Unlock()
+	if vcs.inner[index].version != expectedVersion {
+		return storage.ErrVersionConflict
+	}
+	vcs.inner[index] = value
+	return nil
+}
+
+func TestStorageCompareAndSet(t *testing.T) {
+	cold := NewTestColdStorage[VersionedValue]()
+	cache := internal.NewCachedStorage[VersionedValue](context.Background(), cold, nil, 10)
+	if err := cache.CompareAndSet("1", 0, VersionedValue{"1", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.CompareAndSet("1", 0, VersionedValue{"1", 1}); !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatal("Expected a stale write to be rejected, got ", err)
+	}
+	if err := cache.CompareAndSet("1", 1, VersionedValue{"1", 1}); !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatal("Expected a value not past the expected version to be rejected, got ", err)
+	}
+	if err := cache.CompareAndSet("1", 1, VersionedValue{"1", 2}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cache.Get([]string{"1"}); res["1"].version != 2 {
+		t.Fatal("Expected version 2 to be cached, got ", res)
+	}
+
+	indexed := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), NewTestColdStorage[storage.Indexed[int]](), nil, 10)
+	if err := indexed.CompareAndSet("1", 0, storage.NewIndexed("1", 1)); !errors.Is(err, storage.ErrNotVersioned) {
+		t.Fatal("Expected ErrNotVersioned, got ", err)
+	}
+
+	mixed := internal.NewCachedStorage[storage.Indexable](context.Background(), NewTestColdStorage[storage.Indexable](), nil, 10)
+	mixed.Set([]storage.Indexable{storage.NewIndexed("1", 1)})
+	if err := mixed.CompareAndSet("1", 0, VersionedValue{"1", 1}); !errors.Is(err, storage.ErrNotVersioned) {
+		t.Fatal("Expected ErrNotVersioned for a cached value not versioned, got ", err)
+	}
+}
+
+func TestStorageCompareAndSetForwardsToColdStorage(t *testing.T) {
+	cold := &VersioningColdStorage{TestColdStorage: NewTestColdStorage[VersionedValue]()}
+	cache := internal.NewCachedStorage[VersionedValue](context.Background(), cold, nil, 10)
+	if err := cache.CompareAndSet("1", 0, VersionedValue{"1", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if cold.inner["1"].version != 1 {
+		t.Fatal("Expected the cold storage to be written synchronously")
+	}
+	// another process moves the cold storage ahead of the cache
+	cold.lock.Lock()
+	cold.inner["1"] = VersionedValue{"1", 5}
+	cold.lock.Unlock()
+	if err := cache.CompareAndSet("1", 1, VersionedValue{"1", 2}); !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatal("Expected the cold storage to reject the write, got ", err)
+	}
+	if res, _ := cache.Get([]string{"1"}); res["1"].version != 5 {
+		t.Fatal("Expected the stale cached value to be dropped, got ", res)
+	}
+	if err := cache.CompareAndSet("1", 5, VersionedValue{"1", 6}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageUpdateIsAtomic(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cold.inner["counter"] = storage.NewIndexed("counter", 100)
+	cache := internal.NewCachedStorage[storage.Indexed[int]](context.Background(), cold, nil, 10)
+	increment := func(old storage.Indexed[int], found bool) (storage.Indexed[int], error) {
+		if !found {
+			return old, errors.New("counter should be loaded from the cold storage")
+		}
+		return storage.NewIndexed("counter", old.Value+1), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cache.Update("counter", increment); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	failing := errors.New("abort")
+	if err := cache.Update("counter", func(storage.Indexed[int], bool) (storage.Indexed[int], error) {
+		return storage.NewIndexed("counter", 0), failing
+	}); !errors.Is(err, failing) {
+		t.Fatal("Expected the error of fn, got ", err)
+	}
+	if res, _ := cache.Get([]string{"counter"}); res["counter"].Value != 150 {
+		t.Fatal("Expected every increment to be kept, got ", res["counter"].Value)
+	}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	setted := cold.CollectSetted(ctx, 50)
+	if len(setted) != 50 || setted[49].Value != 150 {
+		t.Fatal("Expected the increments to be persisted in order, got ", setted)
+	}
+}
+
+func TestStorageRemembersMissingIndexes(t *testing.T) {
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.inner["deleted"] = storage.NewIndexed("deleted", 1)
+	config := internal.DefaultConfig()
+	config.NegativeTTL = 50 * time.Millisecond
+	config.NegativeMaxUnits = 10
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if res, _ := cache.Get([]string{"missing"}); len(res) != 0 {
+			t.Fatal("Expected missing to be missing, got ", res)
+		}
+	}
+	if gets := cold.gets.Load(); gets != 1 {
+		t.Fatal("Expected a single cold storage lookup, got ", gets)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("missing", 2)})
+	if res, _ := cache.Get([]string{"missing"}); res["missing"].Value != 2 {
+		t.Fatal("Expected a write to forget the index was missing, got ", res)
+	}
+
+	cache.Delete([]string{"deleted"})
+	if res, _ := cache.Get([]string{"deleted"}); len(res) != 0 {
+		t.Fatal("Expected a deleted index to be missing before the cold storage deletes it, got ", res)
+	}
+	// the lookups wait for the delete to reach the cold storage as well
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	gets := cold.gets.Load()
+	time.Sleep(60 * time.Millisecond)
+	cache.Get([]string{"deleted"})
+	if cold.gets.Load() != gets+1 {
+		t.Fatal("Expected the cold storage to be asked again once the ttl elapsed")
+	}
+}
+
+func TestStorageShardsKeepAGlobalCapacity(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	config := internal.DefaultConfig()
+	config.Shards = 4
+	config.MaxUnits = 40
+	config.EvictionHeadroom = 0
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig(context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i * 10; j < (i+1)*10; j++ {
+				cache.Set([]storage.Indexed[int]{storage.NewIndexed(strconv.Itoa(j), j)})
+				cache.Get([]string{strconv.Itoa(j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Size != 40 || stats.Hits != 40 {
+		t.Fatal("Expected the stats to cover every shard, got ", stats)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("extra", 40)})
+	if evicted := cold.CollectDeleted(ctx, 1); len(evicted) != 1 {
+		t.Fatal("Expected an eviction over all the shards, got ", evicted)
+	}
+	if size := cache.Stats().Size; size > 40 {
+		t.Error("Expected the cache to be back within its max units, got ", size)
+	}
+}
+
+func TestStorageEvictsOnWeightWithPolicy(t *testing.T) {
+	cold := NewTestColdStorage[storage.Indexed[string]]()
+	config := internal.DefaultConfig()
+	config.MaxBytes = 80
+	config.EvictionHeadroom = 0
+	config.EvictionPolicy = policy.NewLRU
+	config.Weigher = func(v storage.Indexed[string]) int { return len(v.Value) }
+	config.Trash = cold
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[string]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 20)
+	for i := 1; i <= 4; i++ {
+		cache.Set([]storage.Indexed[string]{storage.NewIndexed(strconv.Itoa(i), value)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[string]{storage.NewIndexed("5", value)})
+	if r := cold.CollectDeleted(ctx, 1); len(r) != 1 || r[0].Index() != "4" {
+		t.Error("Expected the least recently used value to be evicted, got ", r)
+	}
+}
+
+func TestStorageEvictsOnWeight(t *testing.T) {
+	// unpersisted values are not evictable, the gate keeps them so until the weight is checked
+	cold := NewGatedColdStorage[storage.Indexed[string]]()
+	config := internal.DefaultConfig()
+	config.MaxBytes = 100
+	config.EvictionHeadroom = 0
+	config.Weigher = func(v storage.Indexed[string]) int { return len(v.Value) }
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[string]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 20)
+	for i := 0; i < 10; i++ {
+		cache.Set([]storage.Indexed[string]{storage.NewIndexed(strconv.Itoa(i), value)})
+	}
+	if bytes := cache.Stats().Bytes; bytes != 200 {
+		t.Fatal("Expected the weight of every value, got ", bytes)
+	}
+	close(cold.gate)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[string]{storage.NewIndexed("5", "short")})
+	for cache.Stats().Bytes > 100 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Expected the cache to be evicted under its max bytes, got ", cache.Stats().Bytes)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if stats := cache.Stats(); stats.Bytes != int64(20*(stats.Size-1)+5) {
+		t.Error("Expected the weight to follow the evictions, got ", stats)
+	}
+}
+
+func TestStorageReplaysTheWriteAheadLog(t *testing.T) {
+	path := t.TempDir() + "/wal"
+	config := internal.DefaultConfig()
+	config.WALPath = path
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	down := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	down.failures.Store(1 << 30)
+	ctx, crash := context.WithCancel(context.Background())
+	crashing, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](ctx, down, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashing.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	crashing.Delete([]string{"0"})
+	crashing.Set([]storage.Indexed[int]{storage.NewIndexed("2", 2)})
+	crash()
+	// a record torn by the crash
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 5})
+	file.Close()
+
+	errs := make(chan error, 10)
+	config.OnError = func(err error) { errs <- err }
+	cold := NewTestColdStorage[storage.Indexed[int]]()
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("Expected the torn record to be reported")
+	}
+	if res, _ := cache.Get([]string{"1", "2"}); res["1"].Value != 1 || res["2"].Value != 2 {
+		t.Fatal("Expected the logged writes to be cached again, got ", res)
+	}
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if setted := cold.CollectSetted(ctx, 2); len(setted) != 2 || setted[0].Value != 1 || setted[1].Value != 2 {
+		t.Fatal("Expected the logged writes to be persisted in order, got ", setted)
+	}
+	if removed := <-cold.removed; removed != "0" {
+		t.Fatal("Expected the logged delete to be persisted, got ", removed)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatal("Expected the log to be emptied once everything is persisted, got ", info.Size(), err)
+	}
+}
+
+func TestStorageReplaysMoreThanTheQueueHolds(t *testing.T) {
+	path := t.TempDir() + "/wal"
+	config := internal.DefaultConfig()
+	config.WALPath = path
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	config.Backoff = storage.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	config.OnError = func(error) {}
+	down := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	down.failures.Store(1 << 30)
+	ctx, crash := context.WithCancel(context.Background())
+	crashing, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](ctx, down, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		crashing.Set([]storage.Indexed[int]{storage.NewIndexed(strconv.Itoa(i), i)})
+	}
+	crash()
+
+	config.WriteQueueSize = 4
+	created := make(chan storage.CachedStorage[storage.Indexed[int]], 1)
+	go func() {
+		cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), down, config)
+		if err != nil {
+			t.Error(err)
+		}
+		created <- cache
+	}()
+	var cache storage.CachedStorage[storage.Indexed[int]]
+	select {
+	case cache = <-created:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cache to start while the cold storage is down")
+	}
+	if res, _ := cache.Get([]string{"0", "19"}); res["0"].Value != 0 || res["19"].Value != 19 {
+		t.Fatal("Expected the logged writes to be cached again, got ", res)
+	}
+	if backlog := cache.Backlog(); backlog != 20 {
+		t.Fatal("Expected every logged write to be pending, got ", backlog)
+	}
+	closing, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cache.Close(closing); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Expected Close to give up on the logged writes, got ", err)
+	}
+}
+
+func TestStorageReplaysTheTTLs(t *testing.T) {
+	path := t.TempDir() + "/wal"
+	config := internal.DefaultConfig()
+	config.WALPath = path
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	down := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	down.failures.Store(1 << 30)
+	ctx, crash := context.WithCancel(context.Background())
+	crashing, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](ctx, down, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashing.SetWithTTL([]storage.Indexed[int]{storage.NewIndexed("1", 1)}, 100*time.Millisecond)
+	crash()
+
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), NewTestColdStorage[storage.Indexed[int]](), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 1 {
+		t.Fatal("Expected the logged write to be cached again, got ", res)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cache.Get([]string{"1"}); len(res) != 0 {
+		t.Fatal("Expected the logged write to expire with its own ttl, got ", res)
+	}
+}
+
+func TestStorageCutsTheWriteAheadLogAsWritesPersist(t *testing.T) {
+	path := t.TempDir() + "/wal"
+	config := internal.DefaultConfig()
+	config.WALPath = path
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	config.FlushInterval = 0
+	cold := &GatedColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]](), gate: make(chan struct{})}
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1)})
+	for cold.started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("2", 2)})
+	logged := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	both := logged()
+	// 2 stays queued while 1 is persisted
+	cold.gate <- struct{}{}
+	for cold.started.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if size := logged(); size != both/2 {
+		t.Fatal("Expected the log to be cut past the persisted write, got ", size, " of ", both)
+	}
+	cold.gate <- struct{}{}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if size := logged(); size != 0 {
+		t.Fatal("Expected the log to be emptied once everything is persisted, got ", size)
+	}
+}
+
+func TestStorageRestoresASnapshot(t *testing.T) {
+	config := internal.DefaultConfig()
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	failing := &FailingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	previous, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), failing, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.Set([]storage.Indexed[int]{storage.NewIndexed("1", 1), storage.NewIndexed("2", 2)})
+	if err := previous.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	failing.failures.Store(1 << 30)
+	previous.Set([]storage.Indexed[int]{storage.NewIndexed("3", 3)})
+	var snapshot bytes.Buffer
+	if err := previous.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	previous.Close(ctx)
+
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cache.Get([]string{"1", "2", "3"}); len(res) != 3 || cold.gets.Load() != 0 {
+		t.Fatal("Expected the snapshot to be cached, got ", res)
+	}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.setted) != 1 {
+		t.Fatal("Expected only the unpersisted value to be written, got ", len(cold.setted))
+	}
+	if setted := <-cold.setted; setted.Value != 3 {
+		t.Error("Expected 3 to be persisted, got ", setted)
+	}
+}
+
+func TestStoragePrefetchesInChunks(t *testing.T) {
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	var indexes []string
+	for i := 0; i < 10; i++ {
+		indexes = append(indexes, strconv.Itoa(i))
+		cold.inner[strconv.Itoa(i)] = storage.NewIndexed(strconv.Itoa(i), i)
+	}
+	config := internal.DefaultConfig()
+	config.PrefetchChunkSize = 3
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set([]storage.Indexed[int]{storage.NewIndexed("0", 100)})
+	if err := cache.Prefetch(context.Background(), indexes); err != nil {
+		t.Fatal(err)
+	}
+	if gets := cold.gets.Load(); gets != 3 {
+		t.Fatal("Expected the 9 indexes not cached to be loaded in 3 chunks, got ", gets)
+	}
+	if stats := cache.Stats(); stats.Size != 10 || stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatal("Expected the prefetch not to count as reads, got ", stats)
+	}
+	res, _ := cache.Get(indexes)
+	if len(res) != 10 || res["0"].Value != 100 || cold.gets.Load() != 3 {
+		t.Fatal("Expected every index to be served from the cache, got ", res)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cache.Prefetch(ctx, []string{"missing"}); !errors.Is(err, context.Canceled) {
+		t.Fatal("Expected the prefetch to stop with its context, got ", err)
+	}
+}
+
+func TestStorageRefreshesRestoredEntriesAhead(t *testing.T) {
+	config := internal.DefaultConfig()
+	config.Codec = storage.JSONCodec[storage.Indexed[int]]{}
+	config.TTL = 400 * time.Millisecond
+	config.RefreshAhead = 0.5
+	config.RefreshMinReads = 1
+	previous := NewTestColdStorage[storage.Indexed[int]]()
+	previous.inner["1"] = storage.NewIndexed("1", 1)
+	warm, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), previous, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warm.Get([]string{"1"})
+	loaded := time.Now()
+	var snapshot bytes.Buffer
+	if err := warm.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.inner["1"] = storage.NewIndexed("1", 2)
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(loaded.Add(250 * time.Millisecond)))
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 1 {
+		t.Fatal("Expected the restored value while refreshing, got ", res["1"].Value)
+	}
+	// before the restored entry expires, its expiry would reload it too
+	for {
+		if res, _ := cache.Get([]string{"1"}); res["1"].Value == 2 {
+			break
+		}
+		if time.Now().After(loaded.Add(380 * time.Millisecond)) {
+			t.Fatal("Expected the restored entry to be refreshed ahead of its expiry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStorageRefreshesHotEntriesAhead(t *testing.T) {
+	cold := &CountingColdStorage[storage.Indexed[int]]{TestColdStorage: NewTestColdStorage[storage.Indexed[int]]()}
+	cold.inner["1"] = storage.NewIndexed("1", 1)
+	config := internal.DefaultConfig()
+	config.TTL = 200 * time.Millisecond
+	config.RefreshAhead = 0.5
+	config.RefreshMinReads = 2
+	cache, err := internal.NewCachedStorageWithConfig[storage.Indexed[int]](context.Background(), cold, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Get([]string{"1"})
+	cache.Get([]string{"1"})
+	if gets := cold.gets.Load(); gets != 1 {
+		t.Fatal("Expected no refresh while the entry is fresh, got ", gets)
+	}
+	cold.inner["1"] = storage.NewIndexed("1", 2)
+	time.Sleep(120 * time.Millisecond)
+	if res, _ := cache.Get([]string{"1"}); res["1"].Value != 1 {
+		t.Fatal("Expected the cached value while refreshing, got ", res["1"].Value)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Get([]string{"1"})
+		}()
+	}
+	wg.Wait()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if res, _ := cache.Get([]string{"1"}); res["1"].Value == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the entry to be refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if gets := cold.gets.Load(); gets != 2 {
+		t.Fatal("Expected a single refresh, got ", gets-1)
+	}
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+type Config struct {
+	// 0 never evicts
+	MaxUnits int
+	// share of MaxUnits evicted on top of the overflow, keeps evictions from running on every Set
+	EvictionHeadroom float64
+	// builds the policy picking what to evict from the max units of a shard, estimated from MaxBytes without them;
+	// nil evicts the least read units
+	EvictionPolicy func(capacity int) storage.EvictionPolicy
+	// max weight of the cached values before evicting, 0 never evicts on weight; needs a weigher
+	MaxBytes int64
+	// func(T) int weighing the values of the cached type in bytes; nil uses storage.Sizer when the values implement it
+	Weigher any
+	// max indexes per ColdStorage.Get of Prefetch
+	PrefetchChunkSize int
+	// independent lists the units are hashed to, each with its own lock and eviction; MaxUnits stays global
+	Shards int
+	// storage.Trash of the cached type receiving evicted and expired values; nil drops them
+	Trash             any
+	WriteQueueSize    int
+	EvictionQueueSize int
+	// Set persists before caching and returns, or reports, the cold storage error instead of queuing
+	WriteThrough bool
+	// what Set does once the write queue is full
+	Overflow storage.Overflow
+	// file holding the writes spilled by storage.OverflowSpill, truncated when opened
+	SpillPath string
+	// write-ahead log of the queued writes, replayed when the cache starts; empty disables it
+	WALPath string
+	// storage.Codec of the cached type, needed to keep values on disk
+	Codec any
+	// max units per ColdStorage.Set; 0 is unbounded
+	BatchSize int
+	// how long the write routine waits for more writes to join a batch, where writes to the same index are merged;
+	// 0 persists each write on its own
+	FlushInterval time.Duration
+	Backoff       storage.Backoff
+	// called from the write routine, must not block
+	OnError func(error)
+	Metrics storage.Metrics
+	// applied to units set without an explicit ttl and to the ones loaded from the cold storage; 0 never expires
+	TTL time.Duration
+	// how often expired units are swept out of the cache
+	ExpiryInterval time.Duration
+	// share of the ttl left under which a read of a persisted unit reloads it in the background, within (0, 1); 0 disables it
+	RefreshAhead float64
+	// reads a unit needs to be refreshed ahead, the rarely read ones are left to expire
+	RefreshMinReads uint32
+	// how long an index the cold storage did not have is answered as missing without asking it again; 0 disables it
+	NegativeTTL time.Duration
+	// max amount of missing indexes remembered, the oldest are forgotten first
+	NegativeMaxUnits int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		EvictionHeadroom:  0.2,
+		Shards:            1,
+		PrefetchChunkSize: 100,
+		WriteQueueSize:    100,
+		EvictionQueueSize: 100,
+		Backoff:           storage.DefaultBackoff(),
+		OnError:           func(error) {},
+		Metrics:           storage.NopMetrics{},
+		ExpiryInterval:    time.Second,
+	}
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if c.MaxUnits < 0 {
+		errs = append(errs, errors.New("max units must not be negative"))
+	}
+	if c.MaxBytes < 0 {
+		errs = append(errs, errors.New("max bytes must not be negative"))
+	}
+	if c.EvictionHeadroom < 0 || c.EvictionHeadroom >= 1 {
+		errs = append(errs, errors.New("eviction headroom must be within [0, 1)"))
+	}
+	if c.EvictionPolicy != nil && c.MaxUnits == 0 && c.MaxBytes == 0 {
+		errs = append(errs, errors.New("eviction policy needs a max units or max bytes"))
+	}
+	if c.PrefetchChunkSize < 1 {
+		errs = append(errs, errors.New("prefetch chunk size must be at least 1"))
+	}
+	if c.Shards < 1 {
+		errs = append(errs, errors.New("shards must be at least 1"))
+	}
+	if c.WriteQueueSize < 0 || c.EvictionQueueSize < 0 {
+		errs = append(errs, errors.New("queue sizes must not be negative"))
+	}
+	if c.Overflow < storage.OverflowBlock || c.Overflow > storage.OverflowSpill {
+		errs = append(errs, errors.New("unknown overflow"))
+	}
+	if (c.Overflow == storage.OverflowDropOldest || c.Overflow == storage.OverflowSpill) && c.WriteQueueSize == 0 {
+		errs = append(errs, errors.New("overflow needs a write queue to drop from or to spill after"))
+	}
+	if c.Overflow == storage.OverflowSpill && (c.SpillPath == "" || c.Codec == nil) {
+		errs = append(errs, errors.New("spilling needs a spill path and a codec"))
+	}
+	if c.WALPath != "" && c.Codec == nil {
+		errs = append(errs, errors.New("write-ahead log needs a codec"))
+	}
+	if c.BatchSize < 0 {
+		errs = append(errs, errors.New("batch size must not be negative"))
+	}
+	if c.FlushInterval < 0 {
+		errs = append(errs, errors.New("flush interval must not be negative"))
+	}
+	if c.Backoff.Initial <= 0 || c.Backoff.Max < c.Backoff.Initial || c.Backoff.Multiplier < 1 {
+		errs = append(errs, errors.New("backoff needs a positive initial delay, a max above it and a multiplier of at least 1"))
+	}
+	if c.OnError == nil {
+		errs = append(errs, errors.New("error handler must not be nil"))
+	}
+	if c.Metrics == nil {
+		errs = append(errs, errors.New("metrics must not be nil"))
+	}
+	if c.TTL < 0 {
+		errs = append(errs, errors.New("ttl must not be negative"))
+	}
+	if c.ExpiryInterval <= 0 {
+		errs = append(errs, errors.New("expiry interval must be positive"))
+	}
+	if c.RefreshAhead < 0 || c.RefreshAhead >= 1 {
+		errs = append(errs, errors.New("refresh ahead must be within [0, 1)"))
+	}
+	if c.NegativeTTL < 0 || c.NegativeMaxUnits < 0 {
+		errs = append(errs, errors.New("negative caching must not be negative"))
+	}
+	if c.NegativeTTL > 0 && c.NegativeMaxUnits == 0 {
+		errs = append(errs, errors.New("negative caching needs a max units"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return errors.Join(storage.ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// weight assumed per unit when the policy capacity is estimated from MaxBytes, and the most units it is estimated at:
+// the capacity only tunes the policies, some of which allocate in proportion to it
+const (
+	estimatedUnitBytes   = 1024
+	maxEstimatedCapacity = 1 << 20
+)
+
+// units the eviction policies are sized for, across the shards
+func (c Config) policyCapacity() int {
+	if c.MaxUnits > 0 {
+		return c.MaxUnits
+	}
+	return int(min(max(c.MaxBytes/estimatedUnitBytes, 1), maxEstimatedCapacity))
+}
@@ -0,0 +1,58 @@
+package internal
+
+import "sync"
+
+// a cold storage lookup that concurrent misses of the same index wait on instead of fetching it again
+type flight[T any] struct {
+	done  chan struct{}
+	value T
+	found bool
+	err   error
+}
+
+type flights[T any] struct {
+	lock  sync.Mutex
+	calls map[string]*flight[T]
+}
+
+func newFlights[T any]() *flights[T] {
+	return &flights[T]{calls: make(map[string]*flight[T])}
+}
+
+// splits indexes between the flights the caller now leads and has to land, and the ones already in the air
+func (f *flights[T]) join(indexes []string) (led map[string]*flight[T], joined map[string]*flight[T]) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	led = make(map[string]*flight[T])
+	joined = make(map[string]*flight[T])
+	for _, index := range indexes {
+		if call, ok := f.calls[index]; ok {
+			joined[index] = call
+		} else if _, ok := led[index]; !ok {
+			call := &flight[T]{done: make(chan struct{})}
+			f.calls[index] = call
+			led[index] = call
+		}
+	}
+	return led, joined
+}
+
+// hands the lookup result to every waiter of the led flights
+func (f *flights[T]) land(led map[string]*flight[T], values map[string]T, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for index, call := range led {
+		call.value, call.found = values[index]
+		call.err = err
+		delete(f.calls, index)
+		close(call.done)
+	}
+}
+
+func flightIndexes[T any](calls map[string]*flight[T]) []string {
+	result := make([]string, 0, len(calls))
+	for index := range calls {
+		result = append(result, index)
+	}
+	return result
+}
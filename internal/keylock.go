@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+const keyLockStripes = 64
+
+// striped locks serializing the read-modify-writes of an index, bounded whatever the amount of indexes
+type keyLocks struct {
+	seed    maphash.Seed
+	stripes [keyLockStripes]sync.Mutex
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{seed: maphash.MakeSeed()}
+}
+
+func (k *keyLocks) lock(index string) *sync.Mutex {
+	return &k.stripes[maphash.String(k.seed, index)%keyLockStripes]
+}
@@ -1,80 +1,152 @@
 package listop
 
 import (
-	"container/list"
 	"sync"
-	"sync/atomic"
 
 	"github.com/JGpGH/golfu/storage"
 )
 
-// readCountTracker over an Element with value of type T
-type readCountTracker[T storage.Indexable] struct {
-	Element        *list.Element
-	ReadWriteCount *atomic.Uint32
+// node of the list, ordered from the least read to the most read
+type node[T storage.Indexable] struct {
+	value      T
+	bucket     *bucket[T]
+	prev, next *node[T]
 }
 
-func (c *readCountTracker[T]) Index() string {
-	return c.Element.Value.(T).Index()
+// range of consecutive nodes sharing the same read write count
+type bucket[T storage.Indexable] struct {
+	count uint32
+	// the count is 0 once the list's epoch moved past it
+	epoch      uint64
+	head, tail *node[T]
+	prev, next *bucket[T]
 }
 
-func (c *readCountTracker[T]) Value() T {
-	return c.Element.Value.(T)
-}
+// reads buffered before they are counted, see record
+const readBuffer = 256
 
+// map of values kept in a list sorted by read write count; counting a read or a write is O(1):
+// the node moves to the tail of the next bucket, so equal counts stay in the order they were reached
 type IndexedList[T storage.Indexable] struct {
-	indexed map[string]readCountTracker[T]
-	sorted  list.List
-	lock    sync.RWMutex
+	indexed map[string]*node[T]
+	// list ends
+	head, tail *node[T]
+	// bucket ends, ascending count
+	first, last *bucket[T]
+	// bumped by ClearReadCounts; the buckets of older epochs all come first and count 0
+	epoch uint64
+	// last bucket of an older epoch, nil if none
+	cleared *bucket[T]
+	// nodes read under the read lock, counted under the write lock
+	reads chan *node[T]
+	lock  sync.RWMutex
 }
 
 func NewIndexedList[T storage.Indexable]() IndexedList[T] {
 	return IndexedList[T]{
-		indexed: map[string]readCountTracker[T]{},
-		sorted:  list.List{},
+		indexed: map[string]*node[T]{},
+		reads:   make(chan *node[T], readBuffer),
 		lock:    sync.RWMutex{},
 	}
 }
 
-func (l *IndexedList[T]) readWriteCount(e *list.Element) uint32 {
-	return l.indexed[e.Value.(T).Index()].ReadWriteCount.Load()
-}
-
 func (l *IndexedList[T]) Remove(indexes []string) int {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	l.drain()
 	count := 0
 	for _, index := range indexes {
-		if c, ok := l.indexed[index]; ok {
-			l.sorted.Remove(c.Element)
-			delete(l.indexed, index)
+		if n, ok := l.indexed[index]; ok {
+			l.remove(n)
 			count++
 		}
 	}
 	return count
 }
 
+// reads share the lock, they are counted once the list is changed or its counts are read
 func (l *IndexedList[T]) Get(indexes []string) map[string]T {
 	l.lock.RLock()
-	defer l.lock.RUnlock()
 	res := make(map[string]T)
+	var read []*node[T]
 	for _, index := range indexes {
-		if c, ok := l.indexed[index]; ok {
-			c.ReadWriteCount.Add(1)
-			res[index] = c.Value()
+		if n, ok := l.indexed[index]; ok {
+			res[index] = n.value
+			read = append(read, n)
 		}
 	}
+	l.lock.RUnlock()
+	l.record(read)
 	return res
 }
 
-// returns the read write count for the given indexes; does not affect the count
-func (l *IndexedList[T]) ReadWriteCounts(indexes []string) map[string]uint32 {
+// buffers the reads, the buffer is drained under the write lock once full
+func (l *IndexedList[T]) record(read []*node[T]) {
+	for i, n := range read {
+		select {
+		case l.reads <- n:
+		default:
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.drain()
+			for _, n := range read[i:] {
+				l.count(n)
+			}
+			return
+		}
+	}
+}
+
+// counts the buffered reads, must hold the write lock
+func (l *IndexedList[T]) drain() {
+	for {
+		select {
+		case n := <-l.reads:
+			l.count(n)
+		default:
+			return
+		}
+	}
+}
+
+// the buffered reads predate the clearing, there is nothing left to count; must hold the write lock
+func (l *IndexedList[T]) discard() {
+	for {
+		select {
+		case <-l.reads:
+		default:
+			return
+		}
+	}
+}
+
+// counts a read of n unless it was removed since
+func (l *IndexedList[T]) count(n *node[T]) {
+	if l.indexed[n.value.Index()] == n {
+		l.increment(n)
+	}
+}
+
+// like Get for a single index but does not affect the count
+func (l *IndexedList[T]) Lookup(index string) (T, bool) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
+	if n, ok := l.indexed[index]; ok {
+		return n.value, true
+	}
+	var zero T
+	return zero, false
+}
+
+// returns the read write count for the given indexes; does not affect the count
+func (l *IndexedList[T]) ReadWriteCounts(indexes []string) map[string]uint32 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
 	res := make(map[string]uint32)
 	for _, index := range indexes {
-		if c, ok := l.indexed[index]; ok {
-			res[index] = c.ReadWriteCount.Load()
+		if n, ok := l.indexed[index]; ok {
+			res[index] = l.countOf(n.bucket)
 		}
 	}
 	return res
@@ -82,98 +154,320 @@ func (l *IndexedList[T]) ReadWriteCounts(indexes []string) map[string]uint32 {
 
 // returns read write counts in order that they appear in the current buffer's list
 func (l *IndexedList[T]) OrderedReadWriteCounts() []uint32 {
-	l.lock.RLock()
-	defer l.lock.RUnlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
 	var result []uint32
-	for e := l.sorted.Front(); e != nil; e = e.Next() {
-		result = append(result, l.readWriteCount(e))
+	for n := l.head; n != nil; n = n.next {
+		result = append(result, l.countOf(n.bucket))
 	}
 	return result
 }
 
-func (l *IndexedList[T]) Set(values []T) {
+// returns the values that got replaced
+func (l *IndexedList[T]) Set(values []T) []T {
+	replaced, _ := l.SetWhere(values, nil)
+	return replaced
+}
+
+// like Set but a value only replaces the one already at its index when replace accepts it, nil accepts all;
+// returns the values that got replaced and the values that were not set
+func (l *IndexedList[T]) SetWhere(values []T, replace func(old T) bool) (replaced []T, skipped []T) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	l.drain()
 	for _, v := range values {
-		if c, ok := l.indexed[v.Index()]; ok {
-			c.Element.Value = v
-			c.ReadWriteCount.Add(1)
-		} else {
-			c := readCountTracker[T]{
-				Element:        l.sorted.PushBack(v),
-				ReadWriteCount: &atomic.Uint32{},
+		if n, ok := l.indexed[v.Index()]; ok {
+			if replace != nil && !replace(n.value) {
+				skipped = append(skipped, v)
+				continue
 			}
-			c.ReadWriteCount.Add(1)
-			l.indexed[v.Index()] = c
+			replaced = append(replaced, n.value)
+			n.value = v
+			l.increment(n)
+		} else {
+			l.insert(v)
+		}
+	}
+	return replaced, skipped
+}
+
+// removes the given indexes that satisfy predicate, checked under the same lock
+func (l *IndexedList[T]) RemoveWhere(indexes []string, predicate func(T) bool) []T {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
+	var result []T
+	for _, index := range indexes {
+		if n, ok := l.indexed[index]; ok && predicate(n.value) {
+			result = append(result, n.value)
+			l.remove(n)
 		}
 	}
+	return result
 }
 
 func (l *IndexedList[T]) PopWhere(predicate func(T) bool, amount int) []T {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	l.drain()
 	var result []T
-	for e := l.sorted.Front(); e != nil && amount > 0; {
-		next := e.Next()
-		asT := e.Value.(T)
-		if predicate(asT) {
-			result = append(result, asT)
-			delete(l.indexed, asT.Index())
-			l.sorted.Remove(e)
+	for n := l.head; n != nil && amount > 0; {
+		next := n.next
+		if predicate(n.value) {
+			result = append(result, n.value)
+			l.remove(n)
 			amount--
 		}
-		e = next
+		n = next
+	}
+	return result
+}
+
+// like PopWhere but only among the amount least read values, the ones predicate rejects keep their place
+func (l *IndexedList[T]) PopLeastReadWhere(predicate func(T) bool, amount int) []T {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
+	var result []T
+	for n := l.head; n != nil && amount > 0; amount-- {
+		next := n.next
+		if predicate(n.value) {
+			result = append(result, n.value)
+			l.remove(n)
+		}
+		n = next
 	}
 	return result
 }
 
+// returns the values with their read write count, from the least read to the most read
+func (l *IndexedList[T]) Entries() ([]T, []uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
+	values := make([]T, 0, len(l.indexed))
+	counts := make([]uint32, 0, len(l.indexed))
+	for n := l.head; n != nil; n = n.next {
+		values = append(values, n.value)
+		counts = append(counts, l.countOf(n.bucket))
+	}
+	return values, counts
+}
+
+// inserts values with the read write count they had, e.g. in another list; values already present are skipped
+func (l *IndexedList[T]) Restore(values []T, counts []uint32) (skipped []T) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain()
+	for i, v := range values {
+		if _, ok := l.indexed[v.Index()]; ok {
+			skipped = append(skipped, v)
+			continue
+		}
+		n := &node[T]{value: v}
+		l.indexed[v.Index()] = n
+		after, target := l.cleared, l.current()
+		for target != nil && target.count < counts[i] {
+			after, target = target, target.next
+		}
+		if target == nil || target.count != counts[i] {
+			target = l.newBucket(counts[i], after)
+		}
+		l.join(n, target)
+	}
+	return skipped
+}
+
 func (l *IndexedList[T]) Len() int {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
-	return l.sorted.Len()
+	return len(l.indexed)
 }
 
 func (l *IndexedList[T]) Pop(amount int) []T {
+	return l.PopWhere(func(T) bool { return true }, amount)
+}
+
+// the list is kept sorted from the least read to the most read on every access, nothing left to do
+func (l *IndexedList[T]) SortByReadCount() {}
+
+// O(1): every bucket becomes one of an older epoch, they keep their order
+func (l *IndexedList[T]) ClearReadCounts() {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	var result []T
-	for e := l.sorted.Front(); e != nil && amount > 0; {
-		next := e.Next()
-		asT := e.Value.(T)
-		result = append(result, asT)
-		delete(l.indexed, asT.Index())
-		l.sorted.Remove(e)
-		amount--
-		e = next
+	l.discard()
+	l.epoch++
+	l.cleared = l.last
+}
+
+func (l *IndexedList[T]) countOf(b *bucket[T]) uint32 {
+	if b.epoch != l.epoch {
+		return 0
 	}
-	return result
+	return b.count
 }
 
-// Insertion sort from the least read to the most read
-func (l *IndexedList[T]) SortByReadCount() {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+// first bucket of the current epoch
+func (l *IndexedList[T]) current() *bucket[T] {
+	if l.cleared == nil {
+		return l.first
+	}
+	return l.cleared.next
+}
+
+// the bucket of the count of 1 if any, and the one a new bucket for it goes after: past the cleared ones
+func (l *IndexedList[T]) firstCount() (after, target *bucket[T]) {
+	after, target = l.cleared, l.current()
+	if target != nil && target.count == 0 {
+		after, target = target, target.next
+	}
+	if target != nil && target.count != 1 {
+		target = nil
+	}
+	return after, target
+}
+
+// a new value starts with a count of 1, after the cleared ones
+func (l *IndexedList[T]) insert(v T) {
+	n := &node[T]{value: v}
+	l.indexed[v.Index()] = n
+	after, target := l.firstCount()
+	if target == nil {
+		target = l.newBucket(1, after)
+	}
+	l.join(n, target)
+}
 
-	if l.sorted.Len() < 2 {
+func (l *IndexedList[T]) increment(n *node[T]) {
+	from := n.bucket
+	if from.epoch != l.epoch {
+		// cleared since it was last counted, unlinked first as it may drop the last cleared bucket
+		l.unlink(n)
+		after, target := l.firstCount()
+		if target == nil {
+			target = l.newBucket(1, after)
+		}
+		l.join(n, target)
+		return
+	}
+	count := from.count + 1
+	if from.head == n && from.tail == n && (from.next == nil || from.next.count != count) {
+		// alone in its bucket, bumping it keeps the order
+		from.count = count
 		return
 	}
+	var to *bucket[T]
+	if from.next != nil && from.next.count == count {
+		to = from.next
+	}
+	l.unlink(n)
+	if to == nil {
+		// from may have been emptied and dropped, its prev is still in place
+		if from.head == nil {
+			to = l.newBucket(count, from.prev)
+		} else {
+			to = l.newBucket(count, from)
+		}
+	}
+	l.join(n, to)
+}
+
+func (l *IndexedList[T]) remove(n *node[T]) {
+	l.unlink(n)
+	delete(l.indexed, n.value.Index())
+}
+
+// creates an empty bucket right after the given one, nil puts it first
+func (l *IndexedList[T]) newBucket(count uint32, after *bucket[T]) *bucket[T] {
+	b := &bucket[T]{count: count, epoch: l.epoch, prev: after}
+	if after == nil {
+		b.next = l.first
+		l.first = b
+	} else {
+		b.next = after.next
+		after.next = b
+	}
+	if b.next == nil {
+		l.last = b
+	} else {
+		b.next.prev = b
+	}
+	return b
+}
 
-	for e := l.sorted.Front().Next(); e != nil; {
-		next := e.Next()
-		if l.readWriteCount(e) < l.readWriteCount(e.Prev()) {
-			l.sorted.MoveBefore(e, e.Prev())
-			for e.Prev() != nil && l.readWriteCount(e) < l.readWriteCount(e.Prev()) {
-				l.sorted.MoveBefore(e, e.Prev())
+// appends the node at the tail of the bucket
+func (l *IndexedList[T]) join(n *node[T], b *bucket[T]) {
+	n.bucket = b
+	// a new bucket sits between the tail of the previous bucket and the head of the next one
+	var prev *node[T]
+	switch {
+	case b.tail != nil:
+		prev = b.tail
+	default:
+		for p := b.prev; p != nil; p = p.prev {
+			if p.tail != nil {
+				prev = p.tail
+				break
 			}
 		}
-		e = next
 	}
+	n.prev = prev
+	if prev == nil {
+		n.next = l.head
+		l.head = n
+	} else {
+		n.next = prev.next
+		prev.next = n
+	}
+	if n.next == nil {
+		l.tail = n
+	} else {
+		n.next.prev = n
+	}
+	if b.head == nil {
+		b.head = n
+	}
+	b.tail = n
 }
 
-func (l *IndexedList[T]) ClearReadCounts() {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-	for e := l.sorted.Front(); e != nil; e = e.Next() {
-		l.indexed[e.Value.(T).Index()].ReadWriteCount.Store(0)
+// detaches the node from the list and its bucket, dropping the bucket once empty
+func (l *IndexedList[T]) unlink(n *node[T]) {
+	b := n.bucket
+	switch {
+	case b.head == n && b.tail == n:
+		b.head, b.tail = nil, nil
+		l.dropBucket(b)
+	case b.head == n:
+		b.head = n.next
+	case b.tail == n:
+		b.tail = n.prev
+	}
+	if n.prev == nil {
+		l.head = n.next
+	} else {
+		n.prev.next = n.next
+	}
+	if n.next == nil {
+		l.tail = n.prev
+	} else {
+		n.next.prev = n.prev
+	}
+	n.prev, n.next = nil, nil
+}
+
+func (l *IndexedList[T]) dropBucket(b *bucket[T]) {
+	if b == l.cleared {
+		l.cleared = b.prev
+	}
+	if b.prev == nil {
+		l.first = b.next
+	} else {
+		b.prev.next = b.next
+	}
+	if b.next == nil {
+		l.last = b.prev
+	} else {
+		b.next.prev = b.prev
 	}
 }
@@ -3,6 +3,8 @@ package listop_test
 import (
 	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/JGpGH/golfu/internal/listop"
@@ -255,3 +257,176 @@ func Test_IndexedList_SortByReadCount_NormalyDistributed(t *testing.T) {
 	}
 
 }
+
+func Test_IndexedList_RandomOperationsStaySorted(t *testing.T) {
+	indexedList := listop.NewIndexedList[sortTestStruct]()
+	expected := map[string]uint32{}
+	for i := 0; i < 5000; i++ {
+		s := sortTestStruct(rand.Intn(200))
+		switch op := rand.Intn(10); {
+		case op < 3:
+			indexedList.Set([]sortTestStruct{s})
+			expected[s.Index()]++
+		case op < 8:
+			if len(indexedList.Get([]string{s.Index()})) == 1 {
+				expected[s.Index()]++
+			}
+		case op < 9:
+			indexedList.Remove([]string{s.Index()})
+			delete(expected, s.Index())
+		default:
+			if rand.Intn(20) == 0 {
+				indexedList.ClearReadCounts()
+				for k := range expected {
+					expected[k] = 0
+				}
+			}
+		}
+	}
+	if indexedList.Len() != len(expected) {
+		t.Fatal("Expected ", len(expected), " elements, got ", indexedList.Len())
+	}
+	ordered := indexedList.OrderedReadWriteCounts()
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i-1] > ordered[i] {
+			t.Fatal("Not ordered at index ", i)
+		}
+	}
+	var ids []string
+	for k := range expected {
+		ids = append(ids, k)
+	}
+	for k, v := range indexedList.ReadWriteCounts(ids) {
+		if v != expected[k] {
+			t.Error("Expected ", expected[k], " for ID:", k, ", got ", v)
+		}
+	}
+}
+
+func fill(size int) (*listop.IndexedList[sortTestStruct], []string) {
+	indexedList := listop.NewIndexedList[sortTestStruct]()
+	samples := make([]sortTestStruct, size)
+	ids := make([]string, size)
+	for i := range samples {
+		samples[i] = sortTestStruct(i)
+		ids[i] = samples[i].Index()
+	}
+	indexedList.Set(samples)
+	for i := 0; i < size; i++ {
+		indexedList.Get([]string{ids[rand.Intn(size)]})
+	}
+	return &indexedList, ids
+}
+
+// the eviction path of the cached storage: sort, pop a fifth, clear the counts
+func Benchmark_IndexedList_Evict(b *testing.B) {
+	for _, size := range []int{1_000, 10_000, 100_000, 300_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			indexedList, _ := fill(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				indexedList.SortByReadCount()
+				popped := indexedList.PopWhere(func(sortTestStruct) bool { return true }, size/5)
+				indexedList.ClearReadCounts()
+				b.StopTimer()
+				indexedList.Set(popped)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func Benchmark_IndexedList_Get(b *testing.B) {
+	for _, size := range []int{1_000, 100_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			indexedList, ids := fill(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				indexedList.Get([]string{ids[i%size]})
+			}
+		})
+	}
+}
+
+func Test_IndexedList_RestoreKeepsCounts(t *testing.T) {
+	source := listop.NewIndexedList[*testStruct]()
+	source.Set([]*testStruct{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}})
+	source.Get([]string{"c", "c", "a"})
+	source.Get([]string{"c"})
+	values, counts := source.Entries()
+
+	restored := listop.NewIndexedList[*testStruct]()
+	restored.Set([]*testStruct{{ID: "b"}})
+	skipped := restored.Restore(values, counts)
+	if len(skipped) != 1 || skipped[0].ID != "b" {
+		t.Fatal("Expected the value already present to be skipped, got ", skipped)
+	}
+	expected := map[string]uint32{"a": 2, "b": 1, "c": 4, "d": 1}
+	got := restored.ReadWriteCounts([]string{"a", "b", "c", "d"})
+	for index, count := range expected {
+		if got[index] != count {
+			t.Errorf("Expected %s to be at %d, got %d", index, count, got[index])
+		}
+	}
+	ordered := restored.OrderedReadWriteCounts()
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i-1] > ordered[i] {
+			t.Fatal("Expected the restored list to stay sorted, got ", ordered)
+		}
+	}
+}
+
+func Test_IndexedList_ConcurrentGetsAreCounted(t *testing.T) {
+	indexedList := listop.NewIndexedList[*testStruct]()
+	indexedList.Set([]*testStruct{{ID: "a"}, {ID: "b"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				indexedList.Get([]string{"a"})
+			}
+		}()
+	}
+	wg.Wait()
+	if counts := indexedList.ReadWriteCounts([]string{"a", "b"}); counts["a"] != 8001 || counts["b"] != 1 {
+		t.Fatal("Expected every read to be counted, got ", counts)
+	}
+}
+
+func Test_IndexedList_CountsAfterClearing(t *testing.T) {
+	indexedList := listop.NewIndexedList[*testStruct]()
+	indexedList.Set([]*testStruct{{ID: "a"}, {ID: "b"}, {ID: "c"}})
+	indexedList.Get([]string{"c", "c"})
+	indexedList.ClearReadCounts()
+	indexedList.Get([]string{"a"})
+	indexedList.Set([]*testStruct{{ID: "d"}})
+	values, counts := indexedList.Entries()
+	var order []string
+	for _, v := range values {
+		order = append(order, v.ID)
+	}
+	if strings.Join(order, "") != "bcad" {
+		t.Fatal("Expected the cleared values first in their order, got ", order)
+	}
+	for i, count := range []uint32{0, 0, 1, 1} {
+		if counts[i] != count {
+			t.Fatal("Expected counts 0 0 1 1, got ", counts)
+		}
+	}
+}
+
+func Test_IndexedList_PopLeastReadWhere(t *testing.T) {
+	indexedList := listop.NewIndexedList[*testStruct]()
+	indexedList.Set([]*testStruct{{ID: "a", is_something: true}, {ID: "b"}, {ID: "c"}})
+	indexedList.Get([]string{"b", "c"})
+	popped := indexedList.PopLeastReadWhere(func(v *testStruct) bool { return !v.is_something }, 1)
+	if len(popped) != 0 || indexedList.Len() != 3 {
+		t.Fatal("Expected the least read value to be kept rather than a more read one popped, got ", popped)
+	}
+	popped = indexedList.PopLeastReadWhere(func(v *testStruct) bool { return !v.is_something }, 2)
+	if len(popped) != 1 || popped[0].ID != "b" {
+		t.Fatal("Expected b to be popped, got ", popped)
+	}
+}
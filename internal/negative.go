@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// indexes the cold storage did not have, remembered for a while so their lookups don't reach it again;
+// bounded, the oldest is forgotten first. A nil *negatives remembers nothing
+type negatives struct {
+	lock sync.Mutex
+	ttl  time.Duration
+	max  int
+	// of negative, oldest first
+	order   *list.List
+	indexed map[string]*list.Element
+}
+
+type negative struct {
+	index     string
+	expiresAt time.Time
+}
+
+func newNegatives(ttl time.Duration, max int) *negatives {
+	if ttl <= 0 {
+		return nil
+	}
+	return &negatives{ttl: ttl, max: max, order: list.New(), indexed: make(map[string]*list.Element)}
+}
+
+func (n *negatives) missing(index string, now time.Time) bool {
+	if n == nil {
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	e, ok := n.indexed[index]
+	if !ok {
+		return false
+	}
+	if now.Before(e.Value.(negative).expiresAt) {
+		return true
+	}
+	n.order.Remove(e)
+	delete(n.indexed, index)
+	return false
+}
+
+func (n *negatives) add(indexes []string, now time.Time) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, index := range indexes {
+		if e, ok := n.indexed[index]; ok {
+			n.order.Remove(e)
+		}
+		n.indexed[index] = n.order.PushBack(negative{index: index, expiresAt: now.Add(n.ttl)})
+	}
+	for n.order.Len() > n.max {
+		oldest := n.order.Remove(n.order.Front()).(negative)
+		delete(n.indexed, oldest.index)
+	}
+}
+
+func (n *negatives) remove(indexes []string) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, index := range indexes {
+		if e, ok := n.indexed[index]; ok {
+			n.order.Remove(e)
+			delete(n.indexed, index)
+		}
+	}
+}
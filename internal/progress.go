@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// progress counts the batches handed to the write routine and the ones it is done with;
+// batches are handled in order so waiting on a count waits for everything queued before it
+type progress struct {
+	lock    sync.Mutex
+	queued  uint64
+	done    uint64
+	changed chan struct{}
+}
+
+func newProgress() *progress {
+	return &progress{changed: make(chan struct{})}
+}
+
+// must be called before the batch is sent so queued never lags behind what the routine sees
+func (p *progress) enqueue() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.queued++
+}
+
+func (p *progress) complete(amount uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done += amount
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *progress) target() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.queued
+}
+
+// batches queued the routine is not done with yet
+func (p *progress) pending() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.queued - p.done
+}
+
+// blocks until target batches are done, ctx is done or abort is closed
+func (p *progress) wait(ctx context.Context, abort <-chan struct{}, target uint64) error {
+	for {
+		p.lock.Lock()
+		done, changed := p.done, p.changed
+		p.lock.Unlock()
+		if done >= target {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-abort:
+			return storage.ErrClosed
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// writes as they are kept on disk, by the spill and the write-ahead log
+const (
+	recordSet byte = iota
+	recordDelete
+)
+
+// a record is its kind followed by the units, version, ttl, expiry in unix nanoseconds or 0 and encoded value,
+// or the delete version and indexes
+func encodeWrite[T storage.Indexable](codec storage.Codec[T], w write[T]) ([]byte, error) {
+	var record []byte
+	if len(w.deleted) > 0 {
+		record = append(record, recordDelete)
+		record = binary.AppendUvarint(record, w.version)
+		record = binary.AppendUvarint(record, uint64(len(w.deleted)))
+		for _, index := range w.deleted {
+			record = appendBytes(record, []byte(index))
+		}
+		return record, nil
+	}
+	record = append(record, recordSet)
+	record = binary.AppendUvarint(record, uint64(len(w.units)))
+	for _, u := range w.units {
+		encoded, err := codec.Encode(u.Read())
+		if err != nil {
+			return nil, err
+		}
+		record = binary.AppendUvarint(record, u.version)
+		record = binary.AppendUvarint(record, uint64(u.ttl))
+		var expiresAt int64
+		if !u.expiresAt.IsZero() {
+			expiresAt = u.expiresAt.UnixNano()
+		}
+		record = binary.AppendVarint(record, expiresAt)
+		record = appendBytes(record, encoded)
+	}
+	return record, nil
+}
+
+// resolve gets the decoded unit, to return the unit it was written from or a stand-in when the cache moved on;
+// also returns the length of the records decoded, a torn last one is left out with the error.
+// The writes are logged at the end of their record in data
+func decodeWrites[T storage.Indexable](codec storage.Codec[T], data []byte, resolve func(decoded *unit[T]) *unit[T]) ([]write[T], int, error) {
+	var result []write[T]
+	reader := bytes.NewReader(data)
+	for {
+		decoded := len(data) - reader.Len()
+		kind, err := reader.ReadByte()
+		if err == io.EOF {
+			return result, decoded, nil
+		}
+		if err != nil {
+			return result, decoded, err
+		}
+		if kind != recordSet && kind != recordDelete {
+			return result, decoded, fmt.Errorf("golfu: unknown record kind %d", kind)
+		}
+		var w write[T]
+		if kind == recordDelete {
+			if w.version, err = binary.ReadUvarint(reader); err != nil {
+				return result, decoded, err
+			}
+		}
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return result, decoded, err
+		}
+		for i := uint64(0); i < count; i++ {
+			if kind == recordDelete {
+				index, err := readBytes(reader)
+				if err != nil {
+					return result, decoded, err
+				}
+				w.deleted = append(w.deleted, string(index))
+				continue
+			}
+			version, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return result, decoded, err
+			}
+			ttl, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return result, decoded, err
+			}
+			expiresAt, err := binary.ReadVarint(reader)
+			if err != nil {
+				return result, decoded, err
+			}
+			encoded, err := readBytes(reader)
+			if err != nil {
+				return result, decoded, err
+			}
+			value, err := codec.Decode(encoded)
+			if err != nil {
+				return result, decoded, err
+			}
+			u := newUnit(value, false)
+			u.version, u.ttl = version, time.Duration(ttl)
+			if expiresAt != 0 {
+				u.expiresAt = time.Unix(0, expiresAt)
+			}
+			w.units = append(w.units, resolve(u))
+		}
+		w.logged = int64(len(data) - reader.Len())
+		result = append(result, w)
+	}
+}
+
+func appendBytes(record []byte, data []byte) []byte {
+	record = binary.AppendUvarint(record, uint64(len(data)))
+	return append(record, data...)
+}
+
+func readBytes(reader interface {
+	io.Reader
+	io.ByteReader
+}) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	// read as it comes rather than allocated upfront, a torn size could be anything
+	data, err := io.ReadAll(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"hash/maphash"
+	"time"
+
+	"github.com/JGpGH/golfu/internal/listop"
+	"github.com/JGpGH/golfu/storage"
+)
+
+// a slice of the cached units with its own lock and eviction policy
+type shard[T storage.Indexable] struct {
+	units listop.IndexedList[*unit[T]]
+	// nil uses the read counts of units
+	policy storage.EvictionPolicy
+}
+
+// indexes hashed to independent shards so they don't contend on a single lock
+type shards[T storage.Indexable] struct {
+	seed maphash.Seed
+	all  []*shard[T]
+}
+
+// policy builds the policy of a shard from its share of the capacity, nil uses the read counts
+func newShards[T storage.Indexable](amount int, capacity int, policy func(capacity int) storage.EvictionPolicy) *shards[T] {
+	result := &shards[T]{seed: maphash.MakeSeed(), all: make([]*shard[T], amount)}
+	for i := range result.all {
+		result.all[i] = &shard[T]{units: listop.NewIndexedList[*unit[T]]()}
+		if policy != nil {
+			result.all[i].policy = policy((capacity + amount - 1) / amount)
+		}
+	}
+	return result
+}
+
+func (s *shards[T]) of(index string) *shard[T] {
+	if len(s.all) == 1 {
+		return s.all[0]
+	}
+	return s.all[maphash.String(s.seed, index)%uint64(len(s.all))]
+}
+
+// splits indexes by shard
+func (s *shards[T]) group(indexes []string) map[*shard[T]][]string {
+	result := make(map[*shard[T]][]string)
+	for _, index := range indexes {
+		sh := s.of(index)
+		result[sh] = append(result[sh], index)
+	}
+	return result
+}
+
+func (s *shards[T]) len() int {
+	total := 0
+	for _, sh := range s.all {
+		total += sh.units.Len()
+	}
+	return total
+}
+
+func (s *shards[T]) lookup(index string) (*unit[T], bool) {
+	return s.of(index).units.Lookup(index)
+}
+
+// counts a read of the cached units, and an access for their policy
+func (s *shards[T]) read(indexes []string) map[string]*unit[T] {
+	result := make(map[string]*unit[T], len(indexes))
+	for sh, grouped := range s.group(indexes) {
+		for index, u := range sh.units.Get(grouped) {
+			result[index] = u
+			if sh.policy != nil {
+				sh.policy.Access(index)
+			}
+		}
+	}
+	return result
+}
+
+// caches units and keeps the eviction policies in sync, replace as in IndexedList.SetWhere
+func (s *shards[T]) cache(units []*unit[T], replace func(old *unit[T]) bool) (replaced []*unit[T], skipped []*unit[T]) {
+	grouped := make(map[*shard[T]][]*unit[T])
+	for _, u := range units {
+		sh := s.of(u.Index())
+		grouped[sh] = append(grouped[sh], u)
+	}
+	for sh, units := range grouped {
+		r, k := sh.cache(units, replace)
+		replaced = append(replaced, r...)
+		skipped = append(skipped, k...)
+	}
+	return replaced, skipped
+}
+
+// caches units with their read counts unless their index already is, returns the skipped ones
+func (s *shards[T]) restore(units []*unit[T], counts []uint32) (skipped []*unit[T]) {
+	grouped := make(map[*shard[T]][]int)
+	for i, u := range units {
+		sh := s.of(u.Index())
+		grouped[sh] = append(grouped[sh], i)
+	}
+	for sh, positions := range grouped {
+		shardUnits := make([]*unit[T], len(positions))
+		shardCounts := make([]uint32, len(positions))
+		for i, position := range positions {
+			shardUnits[i], shardCounts[i] = units[position], counts[position]
+		}
+		ignored := make(map[*unit[T]]bool)
+		for _, u := range sh.units.Restore(shardUnits, shardCounts) {
+			ignored[u] = true
+			skipped = append(skipped, u)
+		}
+		if sh.policy == nil {
+			continue
+		}
+		for _, u := range shardUnits {
+			if !ignored[u] {
+				sh.policy.Admit(u.Index())
+			}
+		}
+	}
+	return skipped
+}
+
+// removes the given indexes that satisfy predicate, nil removes them all
+func (s *shards[T]) remove(indexes []string, predicate func(*unit[T]) bool) []*unit[T] {
+	var result []*unit[T]
+	for sh, grouped := range s.group(indexes) {
+		result = append(result, sh.remove(grouped, predicate)...)
+	}
+	return result
+}
+
+// each shard evicts its share of amount, in proportion to its length
+func (s *shards[T]) evict(amount int) []T {
+	result := []T{}
+	if amount <= 0 {
+		return result
+	}
+	total := s.len()
+	for _, sh := range s.all {
+		if len(result) >= amount || total == 0 {
+			break
+		}
+		share := (amount*sh.units.Len() + total - 1) / total
+		result = append(result, sh.evict(min(share, amount-len(result)))...)
+	}
+	return result
+}
+
+func (s *shards[T]) expire(now time.Time) []T {
+	var result []T
+	for _, sh := range s.all {
+		result = append(result, sh.expire(now)...)
+	}
+	return result
+}
+
+func (sh *shard[T]) cache(units []*unit[T], replace func(old *unit[T]) bool) (replaced []*unit[T], skipped []*unit[T]) {
+	replaced, skipped = sh.units.SetWhere(units, replace)
+	if sh.policy == nil {
+		return replaced, skipped
+	}
+	known := make(map[string]bool, len(replaced))
+	for _, r := range replaced {
+		known[r.Index()] = true
+	}
+	ignored := make(map[*unit[T]]bool, len(skipped))
+	for _, u := range skipped {
+		ignored[u] = true
+	}
+	for _, u := range units {
+		if ignored[u] {
+			continue
+		}
+		if known[u.Index()] {
+			sh.policy.Access(u.Index())
+		} else {
+			known[u.Index()] = true
+			sh.policy.Admit(u.Index())
+		}
+	}
+	return replaced, skipped
+}
+
+func (sh *shard[T]) remove(indexes []string, predicate func(*unit[T]) bool) []*unit[T] {
+	if predicate == nil {
+		predicate = func(*unit[T]) bool { return true }
+	}
+	removed := sh.units.RemoveWhere(indexes, predicate)
+	if sh.policy != nil {
+		for _, u := range removed {
+			sh.policy.Forget(u.Index())
+		}
+	}
+	return removed
+}
+
+func (sh *shard[T]) evictable(index string) bool {
+	u, ok := sh.units.Lookup(index)
+	return ok && u.IsPersisted()
+}
+
+func (sh *shard[T]) evict(amount int) []T {
+	if amount <= 0 {
+		return []T{}
+	}
+	if sh.policy != nil {
+		victims := sh.policy.Victims(amount, sh.evictable)
+		evicted := sh.units.RemoveWhere(victims, func(u *unit[T]) bool {
+			return u.IsPersisted()
+		})
+		if len(evicted) < len(victims) {
+			// rewritten since the policy picked them, hand them back
+			removed := make(map[string]bool, len(evicted))
+			for _, u := range evicted {
+				removed[u.Index()] = true
+			}
+			for _, index := range victims {
+				if _, ok := sh.units.Lookup(index); ok && !removed[index] {
+					sh.policy.Admit(index)
+				}
+			}
+		}
+		return values(evicted)
+	}
+	sh.units.SortByReadCount()
+	// the least read units not persisted yet are evicted once they are, rather than units read more often now
+	trashed := sh.units.PopLeastReadWhere(func(u *unit[T]) bool {
+		return u.IsPersisted()
+	}, amount)
+	if len(trashed) > 0 {
+		sh.units.ClearReadCounts()
+	}
+	return values(trashed)
+}
+
+// only removes persisted units, the others are left until they reach the cold storage
+func (sh *shard[T]) expire(now time.Time) []T {
+	expired := sh.units.PopWhere(func(u *unit[T]) bool {
+		return u.Expired(now) && u.IsPersisted()
+	}, sh.units.Len())
+	if sh.policy != nil {
+		for _, u := range expired {
+			sh.policy.Forget(u.Index())
+		}
+	}
+	return values(expired)
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+const snapshotVersion = 1
+
+// a snapshot is its version followed by an entry per cached unit, from the least read to the most read:
+// index, read count, persisted flag, expiry in unix nanoseconds or 0, ttl and encoded value
+func (s *cachedStorage[T]) Snapshot(w io.Writer) error {
+	if s.codec == nil {
+		return fmt.Errorf("%w: snapshots need a codec", storage.ErrInvalidConfig)
+	}
+	out := bufio.NewWriter(w)
+	record := binary.AppendUvarint(nil, snapshotVersion)
+	for _, sh := range s.units.all {
+		units, counts := sh.units.Entries()
+		for i, u := range units {
+			encoded, err := s.codec.Encode(u.Read())
+			if err != nil {
+				return err
+			}
+			record = appendBytes(record, []byte(u.Index()))
+			record = binary.AppendUvarint(record, uint64(counts[i]))
+			persisted := byte(0)
+			if u.IsPersisted() {
+				persisted = 1
+			}
+			record = append(record, persisted)
+			var expiresAt int64
+			if !u.expiresAt.IsZero() {
+				expiresAt = u.expiresAt.UnixNano()
+			}
+			record = binary.AppendVarint(record, expiresAt)
+			record = binary.AppendUvarint(record, uint64(u.ttl))
+			record = appendBytes(record, encoded)
+			if _, err := out.Write(record); err != nil {
+				return err
+			}
+			record = record[:0]
+		}
+	}
+	if _, err := out.Write(record); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// indexes already cached keep their value; expired entries are left out and unpersisted ones are queued again
+func (s *cachedStorage[T]) Restore(r io.Reader) error {
+	if s.codec == nil {
+		return fmt.Errorf("%w: snapshots need a codec", storage.ErrInvalidConfig)
+	}
+	in := bufio.NewReader(r)
+	version, err := binary.ReadUvarint(in)
+	if err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("golfu: unknown snapshot version %d", version)
+	}
+	now := time.Now()
+	var persisted, unpersisted []*unit[T]
+	var persistedCounts, unpersistedCounts []uint32
+	for {
+		index, err := readBytes(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		u, count, err := s.readEntry(in, string(index))
+		if err != nil {
+			return err
+		}
+		if u.Expired(now) || (u.IsPersisted() && s.tombstones.has(u.Index())) {
+			continue
+		}
+		if u.IsPersisted() {
+			persisted = append(persisted, u)
+			persistedCounts = append(persistedCounts, count)
+		} else {
+			unpersisted = append(unpersisted, u)
+			unpersistedCounts = append(unpersistedCounts, count)
+		}
+	}
+	s.restore(persisted, persistedCounts)
+	// only queued when they are to be cached, the cold storage would get the older value otherwise
+	var queued []*unit[T]
+	var queuedCounts []uint32
+	for i, u := range unpersisted {
+		if _, ok := s.units.lookup(u.Index()); !ok {
+			queued = append(queued, u)
+			queuedCounts = append(queuedCounts, unpersistedCounts[i])
+		}
+	}
+	unpersisted, unpersistedCounts = queued, queuedCounts
+	if len(unpersisted) == 0 {
+		return nil
+	}
+	s.stats.unpersisted.Add(int64(len(unpersisted)))
+	err = s.enqueue(context.Background(), write[T]{units: unpersisted}, func() {
+		s.restore(unpersisted, unpersistedCounts)
+		s.tombstones.remove(indexes(unpersisted))
+	})
+	if err != nil {
+		s.stats.unpersisted.Add(-int64(len(unpersisted)))
+	}
+	return err
+}
+
+func (s *cachedStorage[T]) readEntry(in *bufio.Reader, index string) (*unit[T], uint32, error) {
+	count, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	persisted, err := in.ReadByte()
+	if err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	expiresAt, err := binary.ReadVarint(in)
+	if err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	ttl, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	encoded, err := readBytes(in)
+	if err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	value, err := s.codec.Decode(encoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	if value.Index() != index {
+		return nil, 0, fmt.Errorf("golfu: snapshot entry %q decoded as %q", index, value.Index())
+	}
+	u := newUnit(value, persisted == 1)
+	if expiresAt != 0 {
+		u.expiresAt = time.Unix(0, expiresAt)
+		u.ttl = time.Duration(ttl)
+		s.expiring.Store(true)
+	}
+	return u, uint32(count), nil
+}
+
+// caches units with their read counts, like cache does with a count of 1
+func (s *cachedStorage[T]) restore(units []*unit[T], counts []uint32) {
+	skipped := s.units.restore(units, counts)
+	ignored := make(map[*unit[T]]bool, len(skipped))
+	for _, u := range skipped {
+		ignored[u] = true
+	}
+	var restored []*unit[T]
+	for _, u := range units {
+		if !ignored[u] {
+			restored = append(restored, u)
+		}
+	}
+	s.negatives.remove(indexes(restored))
+	s.bytes.Add(s.weighValues(values(restored)))
+	s.signalLength()
+}
+
+// the end of the snapshot is only expected between entries
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
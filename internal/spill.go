@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// writes that did not fit in the write queue, kept in a file until the write routine reads them back;
+// once something is spilled every write is, so they are read back in the order they were made
+type spill struct {
+	lock  sync.Mutex
+	path  string
+	file  *os.File
+	count uint64
+	// end of the last spilled write in the write-ahead log
+	logged int64
+	// signals the write routine something got spilled
+	ready chan struct{}
+}
+
+func openSpill(path string) (*spill, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &spill{path: path, file: file, ready: make(chan struct{}, 1)}, nil
+}
+
+func (s *spill) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.count > 0
+}
+
+func (s *spill) append(record []byte, logged int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+	s.count++
+	s.logged = max(s.logged, logged)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reads every spilled record and empties the file, also returns the end of the last one in the write-ahead log
+func (s *spill) take() ([]byte, uint64, int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count == 0 {
+		return nil, 0, 0, nil
+	}
+	count, logged := s.count, s.logged
+	s.count = 0
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, count, logged, err
+	}
+	data, err := io.ReadAll(s.file)
+	if err != nil {
+		return nil, count, logged, err
+	}
+	return data, count, logged, s.file.Truncate(0)
+}
+
+func (s *spill) close() error {
+	return errors.Join(s.file.Close(), os.Remove(s.path))
+}
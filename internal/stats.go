@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// counters behind Stats, fed as a storage.Metrics
+type stats struct {
+	hits           atomic.Uint64
+	misses         atomic.Uint64
+	coldGets       atomic.Uint64
+	coldGetErrors  atomic.Uint64
+	coldSetBatches atomic.Uint64
+	coldSetErrors  atomic.Uint64
+	evicted        atomic.Uint64
+	expired        atomic.Uint64
+	// units cached but not in the cold storage yet
+	unpersisted atomic.Int64
+}
+
+func (s *stats) Hits(amount int) {
+	s.hits.Add(uint64(amount))
+}
+
+func (s *stats) Misses(amount int) {
+	s.misses.Add(uint64(amount))
+}
+
+func (s *stats) ColdGet(_ time.Duration, err error) {
+	s.coldGets.Add(1)
+	if err != nil {
+		s.coldGetErrors.Add(1)
+	}
+}
+
+func (s *stats) ColdSet(_ int, _ time.Duration, err error) {
+	s.coldSetBatches.Add(1)
+	if err != nil {
+		s.coldSetErrors.Add(1)
+	}
+}
+
+func (s *stats) Evicted(amount int) {
+	s.evicted.Add(uint64(amount))
+}
+
+func (s *stats) Expired(amount int) {
+	s.expired.Add(uint64(amount))
+}
+
+// forwards to every metrics in order
+type multiMetrics []storage.Metrics
+
+func (m multiMetrics) Hits(amount int) {
+	for _, metrics := range m {
+		metrics.Hits(amount)
+	}
+}
+
+func (m multiMetrics) Misses(amount int) {
+	for _, metrics := range m {
+		metrics.Misses(amount)
+	}
+}
+
+func (m multiMetrics) ColdGet(duration time.Duration, err error) {
+	for _, metrics := range m {
+		metrics.ColdGet(duration, err)
+	}
+}
+
+func (m multiMetrics) ColdSet(units int, duration time.Duration, err error) {
+	for _, metrics := range m {
+		metrics.ColdSet(units, duration, err)
+	}
+}
+
+func (m multiMetrics) Evicted(amount int) {
+	for _, metrics := range m {
+		metrics.Evicted(amount)
+	}
+}
+
+func (m multiMetrics) Expired(amount int) {
+	for _, metrics := range m {
+		metrics.Expired(amount)
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import "sync"
+
+// indexes deleted from the cache whose delete has not reached the cold storage yet;
+// the cold storage still has them meanwhile so their lookups must not reach it
+type tombstones struct {
+	lock sync.Mutex
+	// version of the pending delete by index
+	pending map[string]uint64
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{pending: make(map[string]uint64)}
+}
+
+func (t *tombstones) add(indexes []string, version uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, index := range indexes {
+		t.pending[index] = version
+	}
+}
+
+func (t *tombstones) has(index string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.pending[index]
+	return ok
+}
+
+// a newer set of the indexes answers their lookups from the cache
+func (t *tombstones) remove(indexes []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, index := range indexes {
+		delete(t.pending, index)
+	}
+}
+
+// the deletes reached the cold storage or were dropped from the queue, unless deleted again since
+func (t *tombstones) land(versions map[string]uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for index, landed := range versions {
+		if version, ok := t.pending[index]; ok && version == landed {
+			delete(t.pending, index)
+		}
+	}
+}
@@ -3,19 +3,63 @@ package internal
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/JGpGH/golfu/storage"
 )
 
+// orders the writes: unique and increasing for every unit set and every delete
+var unitVersions atomic.Uint64
+
+func nextVersion() uint64 {
+	return unitVersions.Add(1)
+}
+
 type unit[T storage.Indexable] struct {
 	isPersisted *atomic.Bool
 	value       T
-	lock        sync.RWMutex
+	// 0 for the units loaded from the cold storage, they never supersede a write
+	version uint64
+	lock    sync.RWMutex
+	// zero never expires
+	expiresAt time.Time
+	// expiresAt was set from, for refresh-ahead
+	ttl time.Duration
 }
 
 type persistable[T storage.Indexable] struct {
 	value       T
 	isPersisted bool
+	ttl         time.Duration
+}
+
+// a batch for the write routine: already cached units to persist or indexes to delete
+type write[T storage.Indexable] struct {
+	units   []*unit[T]
+	deleted []string
+	// of the delete, a unit written through after it supersedes it
+	version uint64
+	// end of its record in the write-ahead log, 0 when not logged
+	logged int64
+}
+
+// adds the indexes the write touches to seen
+func (w write[T]) touch(seen map[string]bool) {
+	for _, u := range w.units {
+		seen[u.Index()] = true
+	}
+	for _, index := range w.deleted {
+		seen[index] = true
+	}
+}
+
+// version of the delete by deleted index
+func (w write[T]) deletes() map[string]uint64 {
+	versions := make(map[string]uint64, len(w.deleted))
+	for _, index := range w.deleted {
+		versions[index] = w.version
+	}
+	return versions
 }
 
 func values[T storage.Indexable](units []*unit[T]) []T {
@@ -26,6 +70,14 @@ func values[T storage.Indexable](units []*unit[T]) []T {
 	return result
 }
 
+func indexes[T storage.Indexable](units []*unit[T]) []string {
+	var result []string
+	for _, u := range units {
+		result = append(result, u.Index())
+	}
+	return result
+}
+
 func asReadOnlyUnits[T storage.Indexable](units []*unit[T]) []storage.Readonly[T] {
 	var result []storage.Readonly[T]
 	for _, u := range units {
@@ -37,7 +89,12 @@ func asReadOnlyUnits[T storage.Indexable](units []*unit[T]) []storage.Readonly[T
 func toUnits[T storage.Indexable](values []persistable[T]) []*unit[T] {
 	var result []*unit[T]
 	for _, v := range values {
-		result = append(result, newUnit(v.value, v.isPersisted))
+		u := newUnit(v.value, v.isPersisted)
+		if v.ttl > 0 {
+			u.expiresAt = time.Now().Add(v.ttl)
+			u.ttl = v.ttl
+		}
+		result = append(result, u)
 	}
 	return result
 }
@@ -45,11 +102,15 @@ func toUnits[T storage.Indexable](values []persistable[T]) []*unit[T] {
 func newUnit[T storage.Indexable](value T, persisted bool) *unit[T] {
 	isPersisted := &atomic.Bool{}
 	isPersisted.Store(persisted)
-	return &unit[T]{
+	u := &unit[T]{
 		value:       value,
 		lock:        sync.RWMutex{},
 		isPersisted: isPersisted,
 	}
+	if !persisted {
+		u.version = nextVersion()
+	}
+	return u
 }
 
 func (u *unit[T]) Read() T {
@@ -69,14 +130,19 @@ func (u *unit[T]) Write(value T) {
 	u.isPersisted.Store(false)
 }
 
-func (u *unit[T]) SetPersisted() {
-	u.isPersisted.Store(true)
+// reports whether the unit was unpersisted
+func (u *unit[T]) SetPersisted() bool {
+	return !u.isPersisted.Swap(true)
 }
 
 func (u *unit[T]) IsPersisted() bool {
 	return u.isPersisted.Load()
 }
 
+func (u *unit[T]) Expired(now time.Time) bool {
+	return !u.expiresAt.IsZero() && !now.Before(u.expiresAt)
+}
+
 func (u *unit[T]) Index() string {
 	return u.value.Index()
 }
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// write-ahead log of the queued writes, synced before they are acknowledged and cut past the ones persisted;
+// appended to under the ordering lock, cut by the write routine
+type wal struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+	// offsets count every byte ever logged: the file starts at base and ends at size
+	base, size int64
+}
+
+// also returns what the log held, left by a previous process
+func openWAL(path string) (*wal, []byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &wal{path: path, file: file, size: int64(len(data))}, data, nil
+}
+
+// returns the offset of the record, to roll it back to
+func (w *wal) append(record []byte) (int64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	offset := w.size
+	if _, err := w.file.Write(record); err != nil {
+		return offset, errors.Join(err, w.truncate(offset))
+	}
+	if err := w.file.Sync(); err != nil {
+		return offset, errors.Join(err, w.truncate(offset))
+	}
+	w.size += int64(len(record))
+	return offset, nil
+}
+
+func (w *wal) rollback(offset int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.truncate(offset)
+}
+
+func (w *wal) truncate(offset int64) error {
+	if err := w.file.Truncate(offset - w.base); err != nil {
+		return err
+	}
+	w.size = offset
+	return w.file.Sync()
+}
+
+// drops the records before offset, they are persisted; the ones after are rewritten to a new file
+// once they are no more than half of it, so each byte is copied a bounded number of times
+func (w *wal) cut(offset int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if offset >= w.size {
+		if w.size == w.base {
+			return nil
+		}
+		w.base = w.size
+		return w.truncate(w.size)
+	}
+	if offset-w.base < w.size-offset {
+		return nil
+	}
+	rest := make([]byte, w.size-offset)
+	if _, err := w.file.ReadAt(rest, offset-w.base); err != nil {
+		return err
+	}
+	// opened before the rename so appends can't go to a file that is no longer the log
+	file, err := os.OpenFile(w.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(rest); err != nil {
+		return errors.Join(err, file.Close())
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Join(err, file.Close())
+	}
+	if err := os.Rename(w.path+".tmp", w.path); err != nil {
+		return errors.Join(err, file.Close())
+	}
+	previous := w.file
+	w.file, w.base = file, offset
+	return previous.Close()
+}
+
+func (w *wal) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// collects the writes queued within the flush interval, up to the batch size in distinct indexes
+// so a hot index rewritten meanwhile does not cut the batch short
+func (s *cachedStorage[T]) gather(ctx context.Context, first write[T]) []write[T] {
+	pending := []write[T]{first}
+	if s.config.FlushInterval <= 0 {
+		return pending
+	}
+	seen := make(map[string]bool)
+	first.touch(seen)
+	deadline := time.NewTimer(s.config.FlushInterval)
+	defer deadline.Stop()
+	for s.config.BatchSize <= 0 || len(seen) < s.config.BatchSize {
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-deadline.C:
+			return pending
+		case in := <-s.toCache:
+			pending = append(pending, in)
+			in.touch(seen)
+		}
+	}
+	return pending
+}
+
+// persists the pending writes, only the last one to each index reaches the cold storage:
+// the sets left share ColdStorage.Set calls and the deletes left a single Delete
+func (s *cachedStorage[T]) write(ctx context.Context, pending []write[T]) {
+	var order []string
+	latest := make(map[string]*unit[T])
+	deleted := make(map[string]uint64)
+	var superseded []*unit[T]
+	for _, in := range pending {
+		for _, u := range in.units {
+			index := u.Index()
+			if old, ok := latest[index]; ok {
+				superseded = append(superseded, old)
+			} else if _, ok := deleted[index]; !ok {
+				order = append(order, index)
+			}
+			latest[index] = u
+			delete(deleted, index)
+		}
+		for _, index := range in.deleted {
+			if old, ok := latest[index]; ok {
+				superseded = append(superseded, old)
+				delete(latest, index)
+			} else if _, ok := deleted[index]; !ok {
+				order = append(order, index)
+			}
+			deleted[index] = in.version
+		}
+	}
+	// overwritten before reaching the cold storage, nothing left to persist for them
+	for _, u := range superseded {
+		if u.SetPersisted() {
+			s.stats.unpersisted.Add(-1)
+		}
+	}
+
+	var units []*unit[T]
+	var indexes []string
+	for _, index := range order {
+		if u, ok := latest[index]; ok {
+			units = append(units, u)
+		} else {
+			indexes = append(indexes, index)
+		}
+	}
+	s.persistBatches(ctx, units)
+	// a delete the cold storage can't take keeps its tombstone, the indexes stay missing until set again
+	if len(indexes) > 0 && s.persistDelete(ctx, indexes, deleted) {
+		s.tombstones.land(deleted)
+	}
+}
+
+func (s *cachedStorage[T]) persistBatches(ctx context.Context, units []*unit[T]) {
+	size := s.config.BatchSize
+	if size <= 0 {
+		size = len(units)
+	}
+	for len(units) > 0 {
+		batch := units[:min(size, len(units))]
+		units = units[len(batch):]
+		s.persist(ctx, batch)
+	}
+}
+
+func (s *cachedStorage[T]) persist(ctx context.Context, units []*unit[T]) bool {
+	persisted := s.retry(ctx, indexes(units), func() error {
+		s.persisting.Lock()
+		defer s.persisting.Unlock()
+		if units = s.unsuperseded(units); len(units) == 0 {
+			return nil
+		}
+		start := time.Now()
+		err := s.coldSet(ctx, asReadOnlyUnits(units))
+		s.metrics.ColdSet(len(units), time.Since(start), err)
+		return err
+	})
+	if persisted {
+		for _, u := range units {
+			if u.SetPersisted() {
+				s.stats.unpersisted.Add(-1)
+			}
+		}
+		// evictable from now on, see enqueueUnits
+		s.signalLength()
+	}
+	return persisted
+}
+
+func (s *cachedStorage[T]) coldSet(ctx context.Context, values []storage.Readonly[T]) error {
+	if cold, ok := s.cold.(storage.ContextColdStorage[T]); ok {
+		return cold.SetCtx(ctx, values)
+	}
+	return s.cold.Set(values)
+}
+
+func (s *cachedStorage[T]) persistDelete(ctx context.Context, indexes []string, versions map[string]uint64) bool {
+	deleter, ok := s.cold.(storage.Deleter)
+	if !ok {
+		s.config.OnError(&storage.WriteError{Indexes: indexes, Attempt: 1, Err: storage.ErrDeleteUnsupported})
+		return false
+	}
+	return s.retry(ctx, indexes, func() error {
+		s.persisting.Lock()
+		defer s.persisting.Unlock()
+		var current []string
+		for _, index := range indexes {
+			if !s.superseded(index, versions[index]) {
+				current = append(current, index)
+			}
+		}
+		if indexes = current; len(indexes) == 0 {
+			return nil
+		}
+		return deleter.Delete(indexes)
+	})
+}
+
+// leaves out, as persisted, the units a newer write already took to the cold storage
+func (s *cachedStorage[T]) unsuperseded(units []*unit[T]) []*unit[T] {
+	var result []*unit[T]
+	for _, u := range units {
+		if s.superseded(u.Index(), u.version) {
+			if u.SetPersisted() {
+				s.stats.unpersisted.Add(-1)
+			}
+			continue
+		}
+		result = append(result, u)
+	}
+	return result
+}
+
+// only a unit written through can be both newer and persisted before the write routine got to the older one
+func (s *cachedStorage[T]) superseded(index string, version uint64) bool {
+	cached, ok := s.units.lookup(index)
+	return ok && cached.version > version && cached.IsPersisted()
+}
+
+// retries with backoff until write succeeds or ctx is done;
+// blocking the routine keeps later writes of the same index from overtaking a failed one
+func (s *cachedStorage[T]) retry(ctx context.Context, indexes []string, write func() error) bool {
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return true
+		}
+		s.config.OnError(&storage.WriteError{Indexes: indexes, Attempt: attempt, Err: err})
+		retry := time.NewTimer(s.config.Backoff.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			retry.Stop()
+			return false
+		case <-retry.C:
+		}
+	}
+}
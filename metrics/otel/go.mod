@@ -0,0 +1,22 @@
+module github.com/JGpGH/golfu/metrics/otel
+
+go 1.21.1
+
+require (
+	github.com/JGpGH/golfu v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/metric v1.24.0
+	go.opentelemetry.io/otel/sdk/metric v1.24.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/sdk v1.24.0 // indirect
+	go.opentelemetry.io/otel/trace v1.24.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+)
+
+// no release of the core module is tagged yet, this module is not consumable on its own:
+// it builds against the core module of this checkout only
+replace github.com/JGpGH/golfu => ../../
@@ -0,0 +1,125 @@
+// Package otel reports the stats and cold storage latencies of a golfu cached storage through an OpenTelemetry meter.
+//
+//	metrics, err := otel.NewMetrics(meter)
+//	cache, err := golfu.New(ctx, cold, golfu.WithMetrics(metrics))
+//	registration, err := otel.Register(meter, cache)
+package otel
+
+import (
+	"context"
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// anything with stats, e.g. a storage.CachedStorage
+type StatsSource interface {
+	Stats() storage.Stats
+}
+
+type statInstrument struct {
+	name  string
+	help  string
+	value func(storage.Stats) int64
+}
+
+var counters = []statInstrument{
+	{"golfu.cache.hits", "Lookups served by the cache.", func(s storage.Stats) int64 { return int64(s.Hits) }},
+	{"golfu.cache.misses", "Lookups that fell through to the cold storage.", func(s storage.Stats) int64 { return int64(s.Misses) }},
+	{"golfu.cache.cold_gets", "ColdStorage.Get calls.", func(s storage.Stats) int64 { return int64(s.ColdGets) }},
+	{"golfu.cache.cold_get_errors", "ColdStorage.Get calls that failed.", func(s storage.Stats) int64 { return int64(s.ColdGetErrors) }},
+	{"golfu.cache.cold_set_batches", "ColdStorage.Set calls.", func(s storage.Stats) int64 { return int64(s.ColdSetBatches) }},
+	{"golfu.cache.cold_set_errors", "ColdStorage.Set calls that failed.", func(s storage.Stats) int64 { return int64(s.ColdSetErrors) }},
+	{"golfu.cache.evicted", "Values evicted to stay under capacity.", func(s storage.Stats) int64 { return int64(s.Evicted) }},
+	{"golfu.cache.expired", "Values swept once their ttl elapsed.", func(s storage.Stats) int64 { return int64(s.Expired) }},
+}
+
+var gauges = []statInstrument{
+	{"golfu.cache.size", "Values currently cached.", func(s storage.Stats) int64 { return int64(s.Size) }},
+	{"golfu.cache.bytes", "Weight of the cached values.", func(s storage.Stats) int64 { return s.Bytes }},
+	{"golfu.cache.unpersisted", "Cached values not in the cold storage yet.", func(s storage.Stats) int64 { return int64(s.Unpersisted) }},
+	{"golfu.cache.write_queue_depth", "Writes waiting for the write-behind routine.", func(s storage.Stats) int64 { return int64(s.QueueDepth) }},
+}
+
+// observes the stats of source on every collection; unregister the returned registration once the cache is closed
+func Register(meter metric.Meter, source StatsSource) (metric.Registration, error) {
+	type observedStat struct {
+		instrument metric.Int64Observable
+		value      func(storage.Stats) int64
+	}
+	var observables []metric.Observable
+	var observed []observedStat
+	for _, c := range counters {
+		counter, err := meter.Int64ObservableCounter(c.name, metric.WithDescription(c.help))
+		if err != nil {
+			return nil, err
+		}
+		observables = append(observables, counter)
+		observed = append(observed, observedStat{counter, c.value})
+	}
+	for _, g := range gauges {
+		gauge, err := meter.Int64ObservableGauge(g.name, metric.WithDescription(g.help))
+		if err != nil {
+			return nil, err
+		}
+		observables = append(observables, gauge)
+		observed = append(observed, observedStat{gauge, g.value})
+	}
+	hitRatio, err := meter.Float64ObservableGauge("golfu.cache.hit_ratio", metric.WithDescription("Share of the lookups served by the cache."))
+	if err != nil {
+		return nil, err
+	}
+	observables = append(observables, hitRatio)
+
+	return meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stats := source.Stats()
+		for _, stat := range observed {
+			o.ObserveInt64(stat.instrument, stat.value(stats))
+		}
+		o.ObserveFloat64(hitRatio, stats.HitRatio())
+		return nil
+	}, observables...)
+}
+
+// storage.Metrics recording the cold storage latencies in histograms, with an error attribute
+type Metrics struct {
+	storage.NopMetrics
+	coldGet metric.Float64Histogram
+	coldSet metric.Float64Histogram
+}
+
+func NewMetrics(meter metric.Meter) (*Metrics, error) {
+	coldGet, err := meter.Float64Histogram("golfu.cache.cold_get.duration",
+		metric.WithDescription("Latency of ColdStorage.Get."), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	coldSet, err := meter.Float64Histogram("golfu.cache.cold_set.duration",
+		metric.WithDescription("Latency of ColdStorage.Set."), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{coldGet: coldGet, coldSet: coldSet}, nil
+}
+
+var (
+	succeeded = metric.WithAttributes(attribute.Bool("error", false))
+	failed    = metric.WithAttributes(attribute.Bool("error", true))
+)
+
+func (m *Metrics) ColdGet(duration time.Duration, err error) {
+	m.coldGet.Record(context.Background(), duration.Seconds(), outcome(err))
+}
+
+func (m *Metrics) ColdSet(_ int, duration time.Duration, err error) {
+	m.coldSet.Record(context.Background(), duration.Seconds(), outcome(err))
+}
+
+func outcome(err error) metric.RecordOption {
+	if err != nil {
+		return failed
+	}
+	return succeeded
+}
@@ -0,0 +1,72 @@
+package otel_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JGpGH/golfu/metrics/otel"
+	"github.com/JGpGH/golfu/storage"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+type fixedStats storage.Stats
+
+func (f fixedStats) Stats() storage.Stats {
+	return storage.Stats(f)
+}
+
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			result[m.Name] = m.Data
+		}
+	}
+	return result
+}
+
+func TestRegisterObservesStats(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	registration, err := otel.Register(meter, fixedStats{Hits: 3, Misses: 1, QueueDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registration.Unregister()
+	data := collect(t, reader)
+	hits, ok := data["golfu.cache.hits"].(metricdata.Sum[int64])
+	if !ok || hits.DataPoints[0].Value != 3 {
+		t.Error("Expected 3 hits, got ", data["golfu.cache.hits"])
+	}
+	depth, ok := data["golfu.cache.write_queue_depth"].(metricdata.Gauge[int64])
+	if !ok || depth.DataPoints[0].Value != 2 {
+		t.Error("Expected a queue depth of 2, got ", data["golfu.cache.write_queue_depth"])
+	}
+	ratio, ok := data["golfu.cache.hit_ratio"].(metricdata.Gauge[float64])
+	if !ok || ratio.DataPoints[0].Value != 0.75 {
+		t.Error("Expected a hit ratio of 0.75, got ", data["golfu.cache.hit_ratio"])
+	}
+}
+
+func TestMetricsRecordLatencies(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	metrics, err := otel.NewMetrics(meter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.ColdGet(10*time.Millisecond, nil)
+	metrics.ColdSet(2, 20*time.Millisecond, nil)
+	metrics.ColdSet(2, time.Second, context.DeadlineExceeded)
+	data := collect(t, reader)
+	sets, ok := data["golfu.cache.cold_set.duration"].(metricdata.Histogram[float64])
+	if !ok || len(sets.DataPoints) != 2 {
+		t.Error("Expected a histogram per outcome, got ", data["golfu.cache.cold_set.duration"])
+	}
+}
@@ -0,0 +1,127 @@
+// Package prom exposes the stats and cold storage latencies of a golfu cached storage to Prometheus.
+//
+//	metrics := prom.NewMetrics("golfu")
+//	cache, err := golfu.New(ctx, cold, golfu.WithMetrics(metrics))
+//	...
+//	prometheus.MustRegister(metrics, prom.NewCollector("golfu", cache))
+package prom
+
+import (
+	"time"
+
+	"github.com/JGpGH/golfu/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// anything with stats, e.g. a storage.CachedStorage
+type StatsSource interface {
+	Stats() storage.Stats
+}
+
+// reads the stats of a cached storage on every scrape
+type Collector struct {
+	source   StatsSource
+	counters []statDesc
+	gauges   []statDesc
+}
+
+type statDesc struct {
+	desc  *prometheus.Desc
+	value func(storage.Stats) float64
+}
+
+func NewCollector(namespace string, source StatsSource) *Collector {
+	stat := func(name, help string, value func(storage.Stats) float64) statDesc {
+		return statDesc{
+			desc:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, nil, nil),
+			value: value,
+		}
+	}
+	return &Collector{
+		source: source,
+		counters: []statDesc{
+			stat("hits_total", "Lookups served by the cache.", func(s storage.Stats) float64 { return float64(s.Hits) }),
+			stat("misses_total", "Lookups that fell through to the cold storage.", func(s storage.Stats) float64 { return float64(s.Misses) }),
+			stat("cold_gets_total", "ColdStorage.Get calls.", func(s storage.Stats) float64 { return float64(s.ColdGets) }),
+			stat("cold_get_errors_total", "ColdStorage.Get calls that failed.", func(s storage.Stats) float64 { return float64(s.ColdGetErrors) }),
+			stat("cold_set_batches_total", "ColdStorage.Set calls.", func(s storage.Stats) float64 { return float64(s.ColdSetBatches) }),
+			stat("cold_set_errors_total", "ColdStorage.Set calls that failed.", func(s storage.Stats) float64 { return float64(s.ColdSetErrors) }),
+			stat("evicted_total", "Values evicted to stay under capacity.", func(s storage.Stats) float64 { return float64(s.Evicted) }),
+			stat("expired_total", "Values swept once their ttl elapsed.", func(s storage.Stats) float64 { return float64(s.Expired) }),
+		},
+		gauges: []statDesc{
+			stat("size", "Values currently cached.", func(s storage.Stats) float64 { return float64(s.Size) }),
+			stat("bytes", "Weight of the cached values.", func(s storage.Stats) float64 { return float64(s.Bytes) }),
+			stat("unpersisted", "Cached values not in the cold storage yet.", func(s storage.Stats) float64 { return float64(s.Unpersisted) }),
+			stat("write_queue_depth", "Writes waiting for the write-behind routine.", func(s storage.Stats) float64 { return float64(s.QueueDepth) }),
+			stat("hit_ratio", "Share of the lookups served by the cache.", storage.Stats.HitRatio),
+		},
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.counters {
+		ch <- s.desc
+	}
+	for _, s := range c.gauges {
+		ch <- s.desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.source.Stats()
+	for _, s := range c.counters {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, s.value(stats))
+	}
+	for _, s := range c.gauges {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, s.value(stats))
+	}
+}
+
+// storage.Metrics recording the cold storage latencies in histograms, labelled by outcome
+type Metrics struct {
+	storage.NopMetrics
+	coldGet *prometheus.HistogramVec
+	coldSet *prometheus.HistogramVec
+}
+
+func NewMetrics(namespace string) *Metrics {
+	histogram := func(name, help string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      name,
+			Help:      help,
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"outcome"})
+	}
+	return &Metrics{
+		coldGet: histogram("cold_get_duration_seconds", "Latency of ColdStorage.Get."),
+		coldSet: histogram("cold_set_duration_seconds", "Latency of ColdStorage.Set."),
+	}
+}
+
+func (m *Metrics) ColdGet(duration time.Duration, err error) {
+	m.coldGet.WithLabelValues(outcome(err)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ColdSet(_ int, duration time.Duration, err error) {
+	m.coldSet.WithLabelValues(outcome(err)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.coldGet.Describe(ch)
+	m.coldSet.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.coldGet.Collect(ch)
+	m.coldSet.Collect(ch)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,54 @@
+package prom_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JGpGH/golfu/metrics/prom"
+	"github.com/JGpGH/golfu/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fixedStats storage.Stats
+
+func (f fixedStats) Stats() storage.Stats {
+	return storage.Stats(f)
+}
+
+func TestCollectorExposesStats(t *testing.T) {
+	collector := prom.NewCollector("test", fixedStats{Hits: 3, Misses: 1, Evicted: 7, QueueDepth: 2})
+	expected := `
+# HELP test_cache_hit_ratio Share of the lookups served by the cache.
+# TYPE test_cache_hit_ratio gauge
+test_cache_hit_ratio 0.75
+# HELP test_cache_evicted_total Values evicted to stay under capacity.
+# TYPE test_cache_evicted_total counter
+test_cache_evicted_total 7
+# HELP test_cache_write_queue_depth Writes waiting for the write-behind routine.
+# TYPE test_cache_write_queue_depth gauge
+test_cache_write_queue_depth 2
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"test_cache_hit_ratio", "test_cache_evicted_total", "test_cache_write_queue_depth")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsRecordLatencies(t *testing.T) {
+	metrics := prom.NewMetrics("test")
+	metrics.ColdGet(10*time.Millisecond, nil)
+	metrics.ColdGet(time.Second, errors.New("down"))
+	metrics.ColdSet(4, 20*time.Millisecond, nil)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(metrics)
+	if count := testutil.CollectAndCount(metrics, "test_cache_cold_get_duration_seconds"); count != 2 {
+		t.Error("Expected a histogram per outcome, got ", count)
+	}
+	if count := testutil.CollectAndCount(metrics, "test_cache_cold_set_duration_seconds"); count != 1 {
+		t.Error("Expected a single set outcome, got ", count)
+	}
+}
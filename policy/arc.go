@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// adaptive replacement cache: balances recency (t1) against frequency (t2),
+// learning the split from the ghosts (b1, b2) of recently evicted indexes
+type arc struct {
+	lock     sync.Mutex
+	capacity int
+	// target length of t1
+	target   int
+	t1, t2   list.List
+	b1, b2   list.List
+	elements map[string]*list.Element
+}
+
+type arcEntry struct {
+	index string
+	owner *list.List
+}
+
+func NewARC(capacity int) storage.EvictionPolicy {
+	return &arc{
+		capacity: max(capacity, 1),
+		elements: make(map[string]*list.Element, capacity),
+	}
+}
+
+func (p *arc) Admit(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e, ok := p.elements[index]
+	if !ok {
+		p.push(&p.t1, index)
+		p.trimGhosts()
+		return
+	}
+	switch e.Value.(*arcEntry).owner {
+	case &p.b1:
+		// evicted too early for its recency, favor t1
+		p.target = min(p.capacity, p.target+max(p.b2.Len()/p.b1.Len(), 1))
+	case &p.b2:
+		// evicted too early for its frequency, favor t2
+		p.target = max(0, p.target-max(p.b1.Len()/p.b2.Len(), 1))
+	}
+	p.move(e, &p.t2)
+}
+
+func (p *arc) Access(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok && p.resident(e) {
+		p.move(e, &p.t2)
+	}
+}
+
+func (p *arc) Forget(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok {
+		e.Value.(*arcEntry).owner.Remove(e)
+		delete(p.elements, index)
+	}
+}
+
+func (p *arc) Victims(amount int, evictable func(string) bool) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var victims []string
+	// cursors skip over what evictable rejected during this call
+	c1, c2 := p.t1.Front(), p.t2.Front()
+	for len(victims) < amount {
+		c1 = p.nextEvictable(c1, evictable)
+		c2 = p.nextEvictable(c2, evictable)
+		var victim *list.Element
+		var ghosts *list.List
+		switch {
+		case c1 == nil && c2 == nil:
+			return victims
+		case c2 == nil || (c1 != nil && p.t1.Len() > p.target):
+			victim, ghosts = c1, &p.b1
+			c1 = c1.Next()
+		default:
+			victim, ghosts = c2, &p.b2
+			c2 = c2.Next()
+		}
+		victims = append(victims, victim.Value.(*arcEntry).index)
+		p.move(victim, ghosts)
+		p.trimGhosts()
+	}
+	return victims
+}
+
+func (p *arc) nextEvictable(e *list.Element, evictable func(string) bool) *list.Element {
+	for e != nil && !evictable(e.Value.(*arcEntry).index) {
+		e = e.Next()
+	}
+	return e
+}
+
+func (p *arc) resident(e *list.Element) bool {
+	owner := e.Value.(*arcEntry).owner
+	return owner == &p.t1 || owner == &p.t2
+}
+
+func (p *arc) push(owner *list.List, index string) {
+	p.elements[index] = owner.PushBack(&arcEntry{index: index, owner: owner})
+}
+
+func (p *arc) move(e *list.Element, owner *list.List) {
+	entry := e.Value.(*arcEntry)
+	entry.owner.Remove(e)
+	p.push(owner, entry.index)
+}
+
+// keeps |t1|+|b1| <= c and the whole directory <= 2c
+func (p *arc) trimGhosts() {
+	for p.b1.Len() > 0 && p.t1.Len()+p.b1.Len() > p.capacity {
+		p.dropGhost(&p.b1)
+	}
+	for p.b2.Len() > 0 && p.t1.Len()+p.t2.Len()+p.b1.Len()+p.b2.Len() > 2*p.capacity {
+		p.dropGhost(&p.b2)
+	}
+}
+
+func (p *arc) dropGhost(ghosts *list.List) {
+	e := ghosts.Front()
+	ghosts.Remove(e)
+	delete(p.elements, e.Value.(*arcEntry).index)
+}
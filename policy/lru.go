@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// evicts the least recently used index first
+type lru struct {
+	lock     sync.Mutex
+	order    list.List
+	elements map[string]*list.Element
+}
+
+// capacity is unused, the signature matches the other policies
+func NewLRU(capacity int) storage.EvictionPolicy {
+	return &lru{elements: make(map[string]*list.Element, capacity)}
+}
+
+func (p *lru) Admit(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok {
+		p.order.MoveToBack(e)
+		return
+	}
+	p.elements[index] = p.order.PushBack(index)
+}
+
+func (p *lru) Access(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok {
+		p.order.MoveToBack(e)
+	}
+}
+
+func (p *lru) Forget(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok {
+		p.order.Remove(e)
+		delete(p.elements, index)
+	}
+}
+
+func (p *lru) Victims(amount int, evictable func(string) bool) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var victims []string
+	for e := p.order.Front(); e != nil && len(victims) < amount; {
+		next := e.Next()
+		index := e.Value.(string)
+		if evictable(index) {
+			victims = append(victims, index)
+			p.order.Remove(e)
+			delete(p.elements, index)
+		}
+		e = next
+	}
+	return victims
+}
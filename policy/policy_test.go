@@ -0,0 +1,98 @@
+package policy_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/JGpGH/golfu/policy"
+	"github.com/JGpGH/golfu/storage"
+)
+
+var policies = map[string]func(int) storage.EvictionPolicy{
+	"LRU":      policy.NewLRU,
+	"ARC":      policy.NewARC,
+	"WTinyLFU": policy.NewWTinyLFU,
+}
+
+func admit(p storage.EvictionPolicy, prefix string, amount int) []string {
+	var indexes []string
+	for i := 0; i < amount; i++ {
+		index := prefix + strconv.Itoa(i)
+		p.Admit(index)
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+func always(string) bool {
+	return true
+}
+
+func Test_Policies_SkipNonEvictable(t *testing.T) {
+	for name, newPolicy := range policies {
+		p := newPolicy(10)
+		admit(p, "", 10)
+		victims := p.Victims(3, func(index string) bool {
+			return index != "0" && index != "1"
+		})
+		if len(victims) != 3 {
+			t.Error(name, ": expected 3 victims, got ", len(victims))
+		}
+		for _, v := range victims {
+			if v == "0" || v == "1" {
+				t.Error(name, ": evicted non evictable ", v)
+			}
+		}
+	}
+}
+
+func Test_Policies_ForgetAndExhaust(t *testing.T) {
+	for name, newPolicy := range policies {
+		p := newPolicy(10)
+		admit(p, "", 5)
+		p.Forget("2")
+		victims := p.Victims(10, always)
+		if len(victims) != 4 {
+			t.Error(name, ": expected 4 victims, got ", len(victims))
+		}
+		for _, v := range victims {
+			if v == "2" {
+				t.Error(name, ": evicted a forgotten index")
+			}
+		}
+		if victims := p.Victims(1, always); len(victims) != 0 {
+			t.Error(name, ": evicted the same indexes twice")
+		}
+	}
+}
+
+func Test_LRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	p := policy.NewLRU(4)
+	admit(p, "", 4)
+	p.Access("0")
+	p.Access("2")
+	victims := p.Victims(2, always)
+	if len(victims) != 2 || victims[0] != "1" || victims[1] != "3" {
+		t.Error("Expected 1 and 3, got ", victims)
+	}
+}
+
+func Test_Policies_FrequentSurviveScan(t *testing.T) {
+	for _, name := range []string{"ARC", "WTinyLFU"} {
+		p := policies[name](10)
+		hot := admit(p, "hot", 5)
+		for i := 0; i < 5; i++ {
+			for _, index := range hot {
+				p.Access(index)
+			}
+		}
+		admit(p, "scan", 10)
+		for _, v := range p.Victims(5, always) {
+			for _, index := range hot {
+				if v == index {
+					t.Error(name, ": evicted frequently used ", v)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package policy
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+
+	"github.com/JGpGH/golfu/storage"
+)
+
+// W-TinyLFU: new indexes land in a small LRU window, when it overflows its oldest index
+// only enters the main segmented LRU if the frequency sketch rates it above the main victim
+type tinyLFU struct {
+	lock          sync.Mutex
+	windowSize    int
+	mainSize      int
+	protectedSize int
+	window        list.List
+	probation     list.List
+	protected     list.List
+	elements      map[string]*list.Element
+	sketch        *sketch
+}
+
+type tinyLFUEntry struct {
+	index string
+	owner *list.List
+}
+
+func NewWTinyLFU(capacity int) storage.EvictionPolicy {
+	capacity = max(capacity, 1)
+	windowSize := max(capacity/100, 1)
+	mainSize := max(capacity-windowSize, 1)
+	return &tinyLFU{
+		windowSize:    windowSize,
+		mainSize:      mainSize,
+		protectedSize: max(mainSize*4/5, 1),
+		elements:      make(map[string]*list.Element, capacity),
+		sketch:        newSketch(capacity),
+	}
+}
+
+func (p *tinyLFU) Admit(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sketch.increment(index)
+	if e, ok := p.elements[index]; ok {
+		p.touch(e)
+		return
+	}
+	p.push(&p.window, index)
+	// no competition until the main segments are full
+	for p.window.Len() > p.windowSize && p.probation.Len()+p.protected.Len() < p.mainSize {
+		p.move(p.window.Front(), &p.probation)
+	}
+}
+
+func (p *tinyLFU) Access(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sketch.increment(index)
+	if e, ok := p.elements[index]; ok {
+		p.touch(e)
+	}
+}
+
+func (p *tinyLFU) Forget(index string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[index]; ok {
+		e.Value.(*tinyLFUEntry).owner.Remove(e)
+		delete(p.elements, index)
+	}
+}
+
+func (p *tinyLFU) Victims(amount int, evictable func(string) bool) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var victims []string
+	// every round evicts, admits or rotates a rejected index so this bounds the rounds
+	for rounds := 2 * len(p.elements); len(victims) < amount && rounds > 0; rounds-- {
+		var target *list.Element
+		if p.window.Len() > p.windowSize {
+			candidate, victim := p.window.Front(), p.probation.Front()
+			if victim == nil || p.frequency(candidate) > p.frequency(victim) {
+				p.move(candidate, &p.probation)
+				if victim == nil {
+					continue
+				}
+				target = victim
+			} else {
+				target = candidate
+			}
+		} else {
+			target = p.first()
+		}
+		if target == nil {
+			break
+		}
+		entry := target.Value.(*tinyLFUEntry)
+		if evictable(entry.index) {
+			victims = append(victims, entry.index)
+			entry.owner.Remove(target)
+			delete(p.elements, entry.index)
+		} else {
+			entry.owner.MoveToBack(target)
+		}
+	}
+	return victims
+}
+
+func (p *tinyLFU) first() *list.Element {
+	for _, l := range []*list.List{&p.probation, &p.protected, &p.window} {
+		if e := l.Front(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (p *tinyLFU) frequency(e *list.Element) uint8 {
+	return p.sketch.estimate(e.Value.(*tinyLFUEntry).index)
+}
+
+// hits promote probation to protected, overflowing protected demotes its oldest back to probation
+func (p *tinyLFU) touch(e *list.Element) {
+	entry := e.Value.(*tinyLFUEntry)
+	switch entry.owner {
+	case &p.probation:
+		p.move(e, &p.protected)
+		if p.protected.Len() > p.protectedSize {
+			p.move(p.protected.Front(), &p.probation)
+		}
+	default:
+		entry.owner.MoveToBack(e)
+	}
+}
+
+func (p *tinyLFU) push(owner *list.List, index string) {
+	p.elements[index] = owner.PushBack(&tinyLFUEntry{index: index, owner: owner})
+}
+
+func (p *tinyLFU) move(e *list.Element, owner *list.List) {
+	entry := e.Value.(*tinyLFUEntry)
+	entry.owner.Remove(e)
+	p.push(owner, entry.index)
+}
+
+// count-min sketch of 4 rows with counters capped at 15, halved every 10 * capacity increments so old hits fade
+type sketch struct {
+	seed      maphash.Seed
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newSketch(capacity int) *sketch {
+	width := 64
+	for width < capacity {
+		width <<= 1
+	}
+	s := &sketch{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		resetAt: 10 * capacity,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) slots(index string) [4]uint64 {
+	h := maphash.String(s.seed, index)
+	h1, h2 := h&0xffffffff, h>>32|1
+	var slots [4]uint64
+	for i := range slots {
+		slots[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return slots
+}
+
+func (s *sketch) increment(index string) {
+	for i, slot := range s.slots(index) {
+		if s.rows[i][slot] < 15 {
+			s.rows[i][slot]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.additions /= 2
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (s *sketch) estimate(index string) uint8 {
+	estimate := uint8(15)
+	for i, slot := range s.slots(index) {
+		estimate = min(estimate, s.rows[i][slot])
+	}
+	return estimate
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "time"
+
+// delays between attempts to persist a batch the cold storage rejected
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:    100 * time.Millisecond,
+		Max:        30 * time.Second,
+		Multiplier: 2,
+	}
+}
+
+// delay to wait after the given failed attempt, starting at 1
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 1; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+	return min(time.Duration(delay), b.Max)
+}
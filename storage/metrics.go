@@ -0,0 +1,52 @@
+package storage
+
+import "time"
+
+// receives measurements as they happen; called from hot paths and background routines
+// so implementations must be safe for concurrent use and must not block
+type Metrics interface {
+	Hits(amount int)
+	Misses(amount int)
+	ColdGet(duration time.Duration, err error)
+	ColdSet(units int, duration time.Duration, err error)
+	Evicted(amount int)
+	Expired(amount int)
+}
+
+// Metrics discarding everything, embed it to only implement part of the interface
+type NopMetrics struct{}
+
+func (NopMetrics) Hits(int)                          {}
+func (NopMetrics) Misses(int)                        {}
+func (NopMetrics) ColdGet(time.Duration, error)      {}
+func (NopMetrics) ColdSet(int, time.Duration, error) {}
+func (NopMetrics) Evicted(int)                       {}
+func (NopMetrics) Expired(int)                       {}
+
+// snapshot of a CachedStorage counters, the counters only grow over its lifetime
+type Stats struct {
+	Hits           uint64
+	Misses         uint64
+	ColdGets       uint64
+	ColdGetErrors  uint64
+	ColdSetBatches uint64
+	ColdSetErrors  uint64
+	Evicted        uint64
+	Expired        uint64
+	// values currently cached
+	Size int
+	// weight of the cached values, 0 unless they are weighed
+	Bytes int64
+	// cached values not in the cold storage yet
+	Unpersisted int
+	// writes waiting for the write routine
+	QueueDepth int
+}
+
+// share of the lookups served by the cache
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
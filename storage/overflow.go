@@ -0,0 +1,16 @@
+package storage
+
+// what a Set does when the write queue is full
+type Overflow int
+
+const (
+	// waits for room in the queue
+	OverflowBlock Overflow = iota
+	// gives up with ErrQueueFull, leaving the cache untouched
+	OverflowFailFast
+	// makes room by dropping the oldest queued write, reported as ErrQueueFull;
+	// its values leave the cache so reads fall back to the cold storage
+	OverflowDropOldest
+	// appends the writes to a file the write routine reads back once it caught up, needs a Codec
+	OverflowSpill
+)
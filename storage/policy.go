@@ -0,0 +1,13 @@
+package storage
+
+// decides which cached indexes get evicted first; called concurrently from Get and the background routines
+type EvictionPolicy interface {
+	// index entered the cache
+	Admit(index string)
+	// index got read or rewritten while cached
+	Access(index string)
+	// index left the cache without going through Victims
+	Forget(index string)
+	// up to amount indexes to evict, skipping those evictable rejects; returned indexes are forgotten
+	Victims(amount int, evictable func(index string) bool) []string
+}
@@ -1,5 +1,52 @@
 package storage
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// returned once a CachedStorage has been closed or its context is done
+var ErrClosed = errors.New("golfu: cached storage is closed")
+
+// returned by SetCtx, or reported to the error handler, when the write queue is full and its overflow does not wait
+var ErrQueueFull = errors.New("golfu: write queue is full")
+
+// returned by CompareAndSet when the current version is not the expected one
+var ErrVersionConflict = errors.New("golfu: version conflict")
+
+// returned by CompareAndSet for values that do not implement Versioned
+var ErrNotVersioned = errors.New("golfu: value is not versioned")
+
+// wraps every reason a configuration is rejected at construction
+var ErrInvalidConfig = errors.New("golfu: invalid configuration")
+
+// reported when Delete is used over a ColdStorage that does not implement Deleter;
+// the deleted indexes are then kept missing in the cache, until set again or the process ends
+var ErrDeleteUnsupported = errors.New("golfu: cold storage does not support delete")
+
+// reported when the cold storage rejects a batch; the batch stays unpersisted and is retried;
+// Attempt is 0 for the writes that never made it to the write queue
+type WriteError struct {
+	Indexes []string
+	Attempt int
+	Err     error
+}
+
+func (e *WriteError) Error() string {
+	if e.Attempt == 0 {
+		return fmt.Sprintf("golfu: queuing %d units failed: %v", len(e.Indexes), e.Err)
+	}
+	return fmt.Sprintf("golfu: persisting %d units failed (attempt %d): %v", len(e.Indexes), e.Attempt, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
 type Indexable interface {
 	Index() string
 }
@@ -21,6 +68,34 @@ type ColdStorage[T Indexable] interface {
 	Get([]string) (map[string]T, error)
 }
 
+// optional ColdStorage extension used instead of Get and Set so lookups follow the caller's context
+// and writes stop when the cache is closed
+type ContextColdStorage[T Indexable] interface {
+	GetCtx(ctx context.Context, indexes []string) (map[string]T, error)
+	SetCtx(ctx context.Context, values []Readonly[T]) error
+}
+
+// optional ColdStorage extension receiving the deletions made through CachedStorage.Delete
+type Deleter interface {
+	Delete([]string) error
+}
+
+// optional value extension for CompareAndSet; a missing index is at version 0
+type Versioned interface {
+	Version() uint64
+}
+
+// optional ColdStorage extension checking the version itself, e.g. in a transaction, when CompareAndSet writes;
+// returns ErrVersionConflict when the stored version is not the expected one
+type CompareAndSetter[T Indexable] interface {
+	CompareAndSet(index string, expectedVersion uint64, value T) error
+}
+
+// optional value extension giving its weight in bytes, for the max bytes of the cache and its stats
+type Sizer interface {
+	Size() int
+}
+
 type Indexed[T any] struct {
 	index string
 	Value T
@@ -30,6 +105,25 @@ func (i Indexed[T]) Index() string {
 	return i.index
 }
 
+type indexedJSON[T any] struct {
+	Index string `json:"index"`
+	Value T      `json:"value"`
+}
+
+// keeps the index, which is unexported, when encoded e.g. by JSONCodec
+func (i Indexed[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(indexedJSON[T]{Index: i.index, Value: i.Value})
+}
+
+func (i *Indexed[T]) UnmarshalJSON(data []byte) error {
+	var decoded indexedJSON[T]
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	i.index, i.Value = decoded.Index, decoded.Value
+	return nil
+}
+
 func NewIndexed[T any](index string, value T) Indexed[T] {
 	return Indexed[T]{index: index, Value: value}
 }
@@ -39,6 +133,42 @@ type Trash[T Indexable] interface {
 }
 
 type CachedStorage[T Indexable] interface {
+	// visible to Get once it returns, persisted asynchronously;
+	// non-blocking as long as the write queue has room; ignored once closed
 	Set([]T)
+	// like Set but gives up once ctx is done while waiting for room in the write queue,
+	// returns ctx.Err() then and leaves the cache untouched; ErrClosed once closed,
+	// ErrQueueFull when the queue is full and its overflow fails fast
+	SetCtx(ctx context.Context, values []T) error
+	// persists to the cold storage before caching, the cache is left untouched when it fails
+	SetSync([]T) error
+	// sets value, whose Version must be past expectedVersion, only while index is at expectedVersion; ErrVersionConflict otherwise.
+	// persisted like Set unless the cold storage is a CompareAndSetter, then synchronously like SetSync
+	CompareAndSet(index string, expectedVersion uint64, value T) error
+	// read-modify-write of an index, loaded from the cold storage on a miss; fn returning an error aborts it.
+	// atomic against the other Update and CompareAndSet calls, not against Set
+	Update(index string, fn func(old T, found bool) (T, error)) error
+	// like Set but the values are treated as missing once ttl elapsed, whatever their read count
+	SetWithTTL([]T, time.Duration)
 	Get([]string) (map[string]T, error)
+	// like Get but stops waiting for the cold storage once ctx is done, ctx is handed to a ContextColdStorage
+	GetCtx(ctx context.Context, indexes []string) (map[string]T, error)
+	// warms the cache up with the indexes it does not have, loaded from the cold storage in chunks;
+	// unlike Get it does not count them as read
+	Prefetch(ctx context.Context, indexes []string) error
+	// removes from the cache right away, then from the cold storage asynchronously like Set
+	Delete([]string)
+	// drops cached entries only, e.g. when another writer changed the cold storage
+	Invalidate([]string)
+	Stats() Stats
+	// writes the cached values with their read counts and persisted flags, encoded by the configured codec
+	Snapshot(w io.Writer) error
+	// caches what Snapshot wrote, e.g. by a previous process, to start warm; already cached indexes keep their value
+	Restore(r io.Reader) error
+	// writes not persisted yet, spilled ones included; lets producers shed load before the cold storage falls behind
+	Backlog() int
+	// blocks until everything set before the call is persisted in the cold storage
+	Flush(ctx context.Context) error
+	// stops accepting Set, drains pending writes into the cold storage then stops the background routines
+	Close(ctx context.Context) error
 }